@@ -0,0 +1,38 @@
+package sftp
+
+import (
+	"os"
+)
+
+// ACLExtension is the name of the FileAttr extension which carries a file's
+// POSIX access control list. The data is the ACL in the short text form of
+// acl_to_text(3), as accepted by setfacl(1), e.g.
+// "user::rw-,user:1000:r--,group::r--,mask::r--,other::r--", with users and
+// groups given by numeric ID, and the entries of a directory's default ACL
+// prefixed with "default:".
+//
+// HostFS reports it in stat replies if HostFSOpts.ReportACLs is set, for files
+// with an ACL beyond their permission bits. It is only supported on Linux.
+const ACLExtension = "posix-acl@tera-insights.com"
+
+// ACLFromAttr returns the ACL carried by ACLExtension in the given attributes,
+// if present.
+func ACLFromAttr(attr *FileAttr) (acl string, ok bool) {
+	if attr.Flags&AttrFlagExtended == 0 {
+		return "", false
+	}
+	for _, ext := range attr.Extensions {
+		if ext.Name == ACLExtension {
+			return ext.Data, true
+		}
+	}
+	return "", false
+}
+
+// withACL attaches the given ACL, if any, to the info of its file.
+func withACL(fi os.FileInfo, acl string) os.FileInfo {
+	if acl == "" {
+		return fi
+	}
+	return extendedFileInfo{fi, []Extension{{ACLExtension, acl}}}
+}
@@ -0,0 +1,120 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Tags of POSIX ACL entries, as stored in the system.posix_acl_* extended
+// attributes
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclXattrVersion = 2
+)
+
+// pathACL reads the ACL of the named file, following a final symbolic link if
+// follow is set.
+func pathACL(name string, follow bool) string {
+	return readACL(func(attr string, dest []byte) (int, error) {
+		if follow {
+			return unix.Getxattr(name, attr, dest)
+		}
+		return unix.Lgetxattr(name, attr, dest)
+	})
+}
+
+// fileACL reads the ACL of an open file.
+func fileACL(f *os.File) string {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return ""
+	}
+	var acl string
+	rc.Control(func(fd uintptr) {
+		acl = readACL(func(attr string, dest []byte) (int, error) {
+			return unix.Fgetxattr(int(fd), attr, dest)
+		})
+	})
+	return acl
+}
+
+// readACL reads the access ACL, and default ACL if any, of a file, returning
+// an empty string if it has none or they cannot be read.
+func readACL(get func(attr string, dest []byte) (int, error)) string {
+	acl := aclText(getXattr(get, "system.posix_acl_access"), "")
+	if def := aclText(getXattr(get, "system.posix_acl_default"), "default:"); def != "" {
+		if acl != "" {
+			acl += ","
+		}
+		acl += def
+	}
+	return acl
+}
+
+// getXattr reads the named extended attribute, returning nil if the file does
+// not have it, e.g. because the filesystem does not support ACLs.
+func getXattr(get func(attr string, dest []byte) (int, error), attr string) []byte {
+	size, err := get(attr, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	b := make([]byte, size)
+	if size, err = get(attr, b); err != nil {
+		return nil
+	}
+	return b[:size]
+}
+
+// aclText converts an ACL in the little-endian posix_acl_xattr format to the
+// short text form, prefixing each entry with prefix.
+func aclText(b []byte, prefix string) string {
+	if len(b) < 4 || binary.LittleEndian.Uint32(b) != aclXattrVersion {
+		return ""
+	}
+	var entries []string
+	for b = b[4:]; len(b) >= 8; b = b[8:] {
+		tag := binary.LittleEndian.Uint16(b)
+		perm := binary.LittleEndian.Uint16(b[2:])
+		id := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b[4:])), 10)
+
+		var qualifier string
+		switch tag {
+		case aclUserObj:
+			qualifier = "user:"
+		case aclUser:
+			qualifier = "user:" + id
+		case aclGroupObj:
+			qualifier = "group:"
+		case aclGroup:
+			qualifier = "group:" + id
+		case aclMask:
+			qualifier = "mask:"
+		case aclOther:
+			qualifier = "other:"
+		default:
+			continue
+		}
+		rwx := []byte("---")
+		if perm&4 != 0 {
+			rwx[0] = 'r'
+		}
+		if perm&2 != 0 {
+			rwx[1] = 'w'
+		}
+		if perm&1 != 0 {
+			rwx[2] = 'x'
+		}
+		entries = append(entries, prefix+qualifier+":"+string(rwx))
+	}
+	return strings.Join(entries, ",")
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package sftp
+
+import (
+	"os"
+)
+
+func pathACL(name string, follow bool) string {
+	return "" // unsupported
+}
+
+func fileACL(f *os.File) string {
+	return "" // unsupported
+}
@@ -0,0 +1,198 @@
+package sftp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path"
+	"sync"
+)
+
+// AtomicUploads wraps a RequestHandler so that uploads to paths for which match
+// returns true are written to a temporary file beside the final path, which is
+// only renamed into place once the client closes the handle. Partial uploads
+// therefore never appear at the final path, and an upload which is abandoned,
+// because the session ends before the handle is closed, is removed instead.
+//
+// Only opens which replace the file's contents, i.e. with O_TRUNC or O_EXCL,
+// are redirected; others, such as resumed uploads, access the file directly.
+// The temporary file is renamed over any existing file with PosixRename if the
+// handler supports it, or else with Rename. The returned handler implements
+// SessionFactory, and passes sessions through to the wrapped handler if it
+// implements SessionFactory or SessionHandler.
+func AtomicUploads(handler RequestHandler, match func(name string) bool) RequestHandler {
+	return &atomicUploadsFactory{handler, match}
+}
+
+type atomicUploadsFactory struct {
+	RequestHandler
+	match func(name string) bool
+}
+
+// NewSession tracks the uploads of a single session.
+func (f *atomicUploadsFactory) NewSession() RequestHandler {
+	handler := f.RequestHandler
+	if factory, ok := handler.(SessionFactory); ok {
+		handler = factory.NewSession()
+	}
+	return &atomicUploads{
+		RequestHandler: handler,
+		match:          f.match,
+		ctx:            context.Background(),
+		pending:        make(map[*atomicUpload]bool),
+	}
+}
+
+type atomicUploads struct {
+	RequestHandler
+	match func(name string) bool
+
+	ctx        context.Context // canceled when the session ends
+	pending    map[*atomicUpload]bool
+	pendingMtx sync.Mutex
+}
+
+// SessionStart records the session's context, so that handles closed because
+// the session ended are discarded rather than published.
+func (h *atomicUploads) SessionStart(ctx context.Context) error {
+	h.ctx = ctx
+	if sh, ok := h.RequestHandler.(SessionHandler); ok {
+		return sh.SessionStart(ctx)
+	}
+	return nil
+}
+
+// SessionEnd removes the temporary files of any uploads which were never
+// closed.
+func (h *atomicUploads) SessionEnd(err error) {
+	h.pendingMtx.Lock()
+	for u := range h.pending {
+		delete(h.pending, u)
+		u.FileHandle.Close()
+		h.Remove(u.tmpName)
+	}
+	h.pendingMtx.Unlock()
+
+	if sh, ok := h.RequestHandler.(SessionHandler); ok {
+		sh.SessionEnd(err)
+	}
+}
+
+// OpenFile redirects uploads to matching paths to a temporary file.
+func (h *atomicUploads) OpenFile(name string, flag int, perm os.FileMode) (FileHandle, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 || flag&(os.O_TRUNC|os.O_EXCL) == 0 || !h.match(name) {
+		return h.RequestHandler.OpenFile(name, flag, perm)
+	}
+
+	// Racy, but the handler offers no way to check atomically
+	if _, err := h.Stat(name); err == nil && flag&os.O_EXCL != 0 {
+		return nil, ErrFileAlreadyExists
+	} else if err != nil && flag&os.O_CREATE == 0 {
+		return nil, err
+	}
+
+	tmpName, err := uploadTempName(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := h.RequestHandler.OpenFile(tmpName, flag|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &atomicUpload{f, h, name, tmpName}
+	h.pendingMtx.Lock()
+	h.pending[u] = true
+	h.pendingMtx.Unlock()
+	return u, nil
+}
+
+// PosixRename passes through to the wrapped handler if it is a PosixRenamer.
+func (h *atomicUploads) PosixRename(oldpath, newpath string) error {
+	if renamer, ok := h.RequestHandler.(PosixRenamer); ok {
+		return renamer.PosixRename(oldpath, newpath)
+	}
+	return ErrOpUnsupported
+}
+
+// StatVFS passes through to the wrapped handler if it is a StatVFSer.
+func (h *atomicUploads) StatVFS(name string) (*StatVFS, error) {
+	if statter, ok := h.RequestHandler.(StatVFSer); ok {
+		return statter.StatVFS(name)
+	}
+	return nil, ErrOpUnsupported
+}
+
+// Capabilities reports those of the wrapped handler.
+func (h *atomicUploads) Capabilities() Capabilities {
+	return handlerCapabilities(h.RequestHandler)
+}
+
+// uploadTempName returns a hidden, unique name in the same directory as name,
+// so that it can be renamed into place without crossing filesystems.
+func uploadTempName(name string) (string, error) {
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(name), "."+path.Base(name)+".upload-"+hex.EncodeToString(suffix[:])), nil
+}
+
+// atomicUpload is a handle on the temporary file of an upload.
+type atomicUpload struct {
+	FileHandle
+	uploads *atomicUploads
+	name    string
+	tmpName string
+}
+
+// The optional interfaces of the temporary file's handle are passed through.
+
+func (u *atomicUpload) Stat() (os.FileInfo, error) {
+	return statFile(u.FileHandle)
+}
+
+func (u *atomicUpload) Flush() error {
+	return flushFile(u.FileHandle)
+}
+
+func (u *atomicUpload) Preallocate(size int64) error {
+	preallocate(u.FileHandle, size)
+	return nil
+}
+
+func (u *atomicUpload) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	return readAt(ctx, u.FileHandle, p, off)
+}
+
+func (u *atomicUpload) WriteAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	return writeAt(ctx, u.FileHandle, p, off)
+}
+
+// Close publishes the upload by renaming the temporary file into place, unless
+// writing it failed or the session has ended, in which case it is removed.
+func (u *atomicUpload) Close() error {
+	h := u.uploads
+	h.pendingMtx.Lock()
+	if !h.pending[u] {
+		h.pendingMtx.Unlock()
+		return nil // already discarded by SessionEnd
+	}
+	delete(h.pending, u)
+	h.pendingMtx.Unlock()
+
+	err := u.FileHandle.Close()
+	if err == nil && h.ctx.Err() == nil {
+		if _, ok := h.RequestHandler.(PosixRenamer); ok {
+			err = h.PosixRename(u.tmpName, u.name)
+		} else {
+			err = h.Rename(u.tmpName, u.name)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	h.Remove(u.tmpName)
+	return err
+}
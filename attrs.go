@@ -44,8 +44,13 @@ type FileAttr struct {
 	Size            uint64      // Only valid if Flags&AttrFlagSize != 0
 	UID, GID        uint32      // Only valid if Flags&AttrFlagUIDGID != 0
 	Perms           os.FileMode // Only valid if Flags&AttrFlagPermissions != 0
-	AcTime, ModTime time.Time   // Only valid if Flags&AttrFlagAcModTime != 0
+	AcTime, ModTime time.Time   // Only valid if Flags&AttrFlagAcModTime != 0; sent in whole seconds
 	Extensions      []Extension // Only valid if Flags&AttrFlagExtended != 0
+
+	// Device numbers of a block/character special file. These are not part of
+	// the SFTP v3 wire format and are only used for producing long names, so
+	// they are not indicated by Flags. Only valid if Perms&os.ModeDevice != 0.
+	DevMajor, DevMinor uint32
 }
 
 func (attr *FileAttr) encodedSize() int {
@@ -72,13 +77,110 @@ func (attr *FileAttr) encodedSize() int {
 	return size
 }
 
+// ApplyAttr returns a copy of current in which only the fields flagged in
+// incoming have been replaced by their values in incoming, and whose flags are
+// the union of both. This is useful for implementing Setstat, where a client
+// may specify any subset of attributes and the rest must remain untouched.
+func ApplyAttr(current, incoming *FileAttr) *FileAttr {
+	merged := *current
+	merged.Flags |= incoming.Flags
+	if incoming.Flags&AttrFlagSize != 0 {
+		merged.Size = incoming.Size
+	}
+	if incoming.Flags&AttrFlagUIDGID != 0 {
+		merged.UID = incoming.UID
+		merged.GID = incoming.GID
+	}
+	if incoming.Flags&AttrFlagPermissions != 0 {
+		merged.Perms = incoming.Perms
+	}
+	if incoming.Flags&AttrFlagAcModTime != 0 {
+		merged.AcTime = incoming.AcTime
+		merged.ModTime = incoming.ModTime
+	}
+	if incoming.Flags&AttrFlagExtended != 0 {
+		merged.Extensions = incoming.Extensions
+	}
+	return &merged
+}
+
+// Equal reports whether attr and other would be sent to a client identically:
+// their flags must match, and then only the fields those flags include are
+// compared. Times are compared to the second, the precision sent on the wire,
+// and DevMajor and DevMinor, which are never sent, are ignored.
+func (attr *FileAttr) Equal(other *FileAttr) bool {
+	if attr.Flags != other.Flags {
+		return false
+	}
+	if attr.Flags&AttrFlagSize != 0 && attr.Size != other.Size {
+		return false
+	}
+	if attr.Flags&AttrFlagUIDGID != 0 && (attr.UID != other.UID || attr.GID != other.GID) {
+		return false
+	}
+	if attr.Flags&AttrFlagPermissions != 0 && attr.Perms != other.Perms {
+		return false
+	}
+	if attr.Flags&AttrFlagAcModTime != 0 &&
+		(attr.AcTime.Unix() != other.AcTime.Unix() || attr.ModTime.Unix() != other.ModTime.Unix()) {
+		return false
+	}
+	if attr.Flags&AttrFlagExtended != 0 {
+		if len(attr.Extensions) != len(other.Extensions) {
+			return false
+		}
+		for i, ext := range attr.Extensions {
+			if ext != other.Extensions[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fileAttrFromInfo returns the attributes to send to clients for the given
+// os.FileInfo. Times are truncated to whole seconds, as they would be on the
+// wire, so that they match what clients decode even before encoding. A
+// FileAttr provided by fi.Sys() is copied rather than truncated in place, as
+// it may belong to the handler.
 func fileAttrFromInfo(fi os.FileInfo) *FileAttr {
+	if attr, ok := fi.Sys().(*FileAttr); ok {
+		copied := *attr
+		return truncateTimes(&copied)
+	}
+	return truncateTimes(fillFileAttr(&FileAttr{}, fi))
+}
+
+// fileAttrFromInfoInto is identical to fileAttrFromInfo, but decodes into the
+// given FileAttr rather than allocating one. This lets callers converting many
+// entries at once allocate their attributes together.
+func fileAttrFromInfoInto(fi os.FileInfo, attr *FileAttr) *FileAttr {
+	if sysAttr, ok := fi.Sys().(*FileAttr); ok {
+		*attr = *sysAttr
+		return truncateTimes(attr)
+	}
+	return truncateTimes(fillFileAttr(attr, fi))
+}
+
+// exactFileAttrFromInfo is identical to fileAttrFromInfo but keeps the full
+// precision of times, for attributes which are applied to files rather than
+// sent to clients.
+func exactFileAttrFromInfo(fi os.FileInfo) *FileAttr {
 	if attr, ok := fi.Sys().(*FileAttr); ok {
 		return attr
 	}
+	return fillFileAttr(&FileAttr{}, fi)
+}
 
+func truncateTimes(attr *FileAttr) *FileAttr {
+	attr.AcTime = attr.AcTime.Truncate(time.Second)
+	attr.ModTime = attr.ModTime.Truncate(time.Second)
+	return attr
+}
+
+func fillFileAttr(attr *FileAttr, fi os.FileInfo) *FileAttr {
 	mtime := fi.ModTime()
-	attr := &FileAttr{
+	*attr = FileAttr{
 		Flags:   AttrFlagSize | AttrFlagPermissions | AttrFlagAcModTime,
 		Size:    uint64(fi.Size()),
 		Perms:   fi.Mode(),
@@ -89,6 +191,10 @@ func fileAttrFromInfo(fi os.FileInfo) *FileAttr {
 	// OS-specific file stat decoding
 	fileAttrFromInfoOS(fi, attr)
 
+	if exts := fileInfoExtensions(fi); len(exts) > 0 {
+		attr.Flags |= AttrFlagExtended
+		attr.Extensions = append(attr.Extensions, exts...)
+	}
 	return attr
 }
 
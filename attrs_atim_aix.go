@@ -0,0 +1,13 @@
+// +build aix
+// +build cgo
+
+package sftp
+
+import (
+	"syscall"
+	"time"
+)
+
+func statAtime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+}
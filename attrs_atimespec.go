@@ -0,0 +1,13 @@
+// +build darwin freebsd netbsd
+// +build cgo
+
+package sftp
+
+import (
+	"syscall"
+	"time"
+)
+
+func statAtime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Atimespec.Unix())
+}
@@ -9,3 +9,7 @@ import (
 func fileAttrFromInfoOS(fi os.FileInfo, attr *FileAttr) {
 	// todo
 }
+
+func fileInodeOS(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -6,6 +6,8 @@ package sftp
 import (
 	"os"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func fileAttrFromInfoOS(fi os.FileInfo, attr *FileAttr) {
@@ -13,5 +15,21 @@ func fileAttrFromInfoOS(fi os.FileInfo, attr *FileAttr) {
 		attr.Flags |= AttrFlagUIDGID
 		attr.UID = stat.Uid
 		attr.GID = stat.Gid
+		attr.AcTime = statAtime(stat)
+		if flags, ok := fileFlagsFromSys(stat); ok && flags != 0 {
+			attr.Flags |= AttrFlagExtended
+			attr.Extensions = append(attr.Extensions, fileFlagsExtension(flags))
+		}
+		if fi.Mode()&os.ModeDevice != 0 {
+			attr.DevMajor = unix.Major(uint64(stat.Rdev))
+			attr.DevMinor = unix.Minor(uint64(stat.Rdev))
+		}
+	}
+}
+
+func fileInodeOS(fi os.FileInfo) (uint64, bool) {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino), true
 	}
+	return 0, false
 }
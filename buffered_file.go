@@ -0,0 +1,128 @@
+package sftp
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// BufferWrites wraps a FileHandle so that contiguous writes are coalesced in
+// memory and passed to the underlying WriteAt in chunks of at least bufSize
+// bytes. This is useful for backends where each WriteAt call is expensive,
+// since clients upload files as a stream of small SSH_FXP_WRITE packets.
+//
+// A write which does not continue where the buffered data ends flushes the
+// buffer first, so out-of-order writes remain correct. Reads and Setstat calls
+// also flush the buffer before being passed through. The returned handle
+// implements Flusher, so the server flushes it before acknowledging a close.
+func BufferWrites(f FileHandle, bufSize int) FileHandle {
+	return &bufferedFile{
+		FileHandle: f,
+		buf:        make([]byte, 0, bufSize),
+	}
+}
+
+type bufferedFile struct {
+	FileHandle
+	mtx    sync.Mutex
+	buf    []byte
+	offset int64 // file offset of buf[0]
+}
+
+func (f *bufferedFile) ReadAt(dst []byte, offset int64) (int, error) {
+	return f.ReadAtContext(context.Background(), dst, offset)
+}
+
+// ReadAtContext passes the context through to the underlying handle if it is a
+// ContextReaderAt.
+func (f *bufferedFile) ReadAtContext(ctx context.Context, dst []byte, offset int64) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.flush(ctx); err != nil {
+		return 0, err
+	}
+	return readAt(ctx, f.FileHandle, dst, offset)
+}
+
+func (f *bufferedFile) WriteAt(data []byte, offset int64) (int, error) {
+	return f.WriteAtContext(context.Background(), data, offset)
+}
+
+// WriteAtContext passes the context through to the underlying handle, for any
+// writes it triggers, if it is a ContextWriterAt.
+func (f *bufferedFile) WriteAtContext(ctx context.Context, data []byte, offset int64) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if len(f.buf) > 0 && offset != f.offset+int64(len(f.buf)) {
+		if err := f.flush(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.buf) == 0 {
+		if len(data) >= cap(f.buf) {
+			// Nothing to coalesce with; skip the copy
+			return writeAt(ctx, f.FileHandle, data, offset)
+		}
+		f.offset = offset
+	}
+
+	f.buf = append(f.buf, data...)
+	if len(f.buf) >= cap(f.buf) {
+		if err := f.flush(ctx); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (f *bufferedFile) Setstat(attr *FileAttr) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.flush(context.Background()); err != nil {
+		return err
+	}
+	return f.FileHandle.Setstat(attr)
+}
+
+// Stat flushes the buffer so that the reported size accounts for buffered
+// writes, then stats the underlying handle.
+func (f *bufferedFile) Stat() (os.FileInfo, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.flush(context.Background()); err != nil {
+		return nil, err
+	}
+	return statFile(f.FileHandle)
+}
+
+// Flush writes any buffered data to the underlying handle, then flushes the
+// underlying handle itself if it is a Flusher or Syncer.
+func (f *bufferedFile) Flush() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err := f.flush(context.Background()); err != nil {
+		return err
+	}
+	return flushFile(f.FileHandle)
+}
+
+func (f *bufferedFile) Close() error {
+	f.mtx.Lock()
+	err := f.flush(context.Background())
+	f.mtx.Unlock()
+	if cerr := f.FileHandle.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// flush must be called with f.mtx held.
+func (f *bufferedFile) flush(ctx context.Context) error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	_, err := writeAt(ctx, f.FileHandle, f.buf, f.offset)
+	f.buf = f.buf[:0]
+	return err
+}
@@ -0,0 +1,124 @@
+package sftp_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/tera-insights/sftp"
+)
+
+// countingFile counts the calls to WriteAt on a MemFS file.
+type countingFile struct {
+	sftp.FileHandle
+	writes int
+}
+
+func (f *countingFile) WriteAt(p []byte, off int64) (int, error) {
+	f.writes++
+	return f.FileHandle.WriteAt(p, off)
+}
+
+func newCountingFile(t testing.TB) *countingFile {
+	f, err := sftp.MemFS().OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &countingFile{FileHandle: f}
+}
+
+func readAll(t testing.TB, f sftp.FileHandle, size int) []byte {
+	t.Helper()
+	b := make([]byte, size)
+	if n, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		t.Fatalf("ReadAt: %v", err)
+	} else {
+		b = b[:n]
+	}
+	return b
+}
+
+// TestBufferWritesOutOfOrder checks that writes which do not continue the
+// buffered data flush it first, so they land in the right order.
+func TestBufferWritesOutOfOrder(t *testing.T) {
+	backend := newCountingFile(t)
+	f := sftp.BufferWrites(backend, 16)
+
+	for _, w := range []struct {
+		data   string
+		offset int64
+	}{
+		{"hello", 0},
+		{", world", 5},
+		{"W", 7},   // overwrites buffered data
+		{"!", 20},  // leaves a gap
+		{"?", 12},  // fills part of it, before the buffered data
+		{"!!", 13}, // continues the buffered data again
+	} {
+		if n, err := f.WriteAt([]byte(w.data), w.offset); err != nil || n != len(w.data) {
+			t.Fatalf("WriteAt(%q, %d) = %d, %v", w.data, w.offset, n, err)
+		}
+	}
+	if backend.writes != 3 {
+		t.Errorf("%d writes reached the backend before flushing, want 3", backend.writes)
+	}
+	if err := f.(sftp.Flusher).Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	want := []byte("hello, World?!!\x00\x00\x00\x00\x00!")
+	if got := readAll(t, backend, 64); !bytes.Equal(got, want) {
+		t.Fatalf("file contains %q, want %q", got, want)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+// TestBufferWritesReadFlushes checks that reads see buffered writes.
+func TestBufferWritesReadFlushes(t *testing.T) {
+	backend := newCountingFile(t)
+	f := sftp.BufferWrites(backend, 16)
+	f.WriteAt([]byte("data"), 0)
+	if backend.writes != 0 {
+		t.Fatalf("a small write reached the backend unbuffered")
+	}
+	if got := readAll(t, f, 16); string(got) != "data" {
+		t.Fatalf("read %q, want %q", got, "data")
+	}
+	f.Close()
+}
+
+// BenchmarkBufferWrites uploads a file sequentially in 32 KiB chunks, the size
+// clients typically send, reporting how many writes reach the backend.
+func BenchmarkBufferWrites(b *testing.B) {
+	const size, chunkSize = 8 << 20, 32 << 10
+	chunk := make([]byte, chunkSize)
+	for _, bufSize := range []int{0, 1 << 20} {
+		name := "Unbuffered"
+		if bufSize > 0 {
+			name = "Buffered1MiB"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(size)
+			writes := 0
+			for i := 0; i < b.N; i++ {
+				backend := newCountingFile(b)
+				var f sftp.FileHandle = backend
+				if bufSize > 0 {
+					f = sftp.BufferWrites(backend, bufSize)
+				}
+				for off := int64(0); off < size; off += chunkSize {
+					if _, err := f.WriteAt(chunk, off); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := f.Close(); err != nil {
+					b.Fatal(err)
+				}
+				writes += backend.writes
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "backend-writes/op")
+		})
+	}
+}
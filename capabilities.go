@@ -0,0 +1,43 @@
+package sftp
+
+// Capabilities describes which optional operations a RequestHandler supports.
+// The server only advertises extensions the handler is capable of, and rejects
+// requests for unsupported operations with ErrOpUnsupported without calling
+// into the handler.
+type Capabilities struct {
+	// Symlinks reports support for SSH_FXP_SYMLINK and SSH_FXP_READLINK.
+	Symlinks bool
+
+	// PosixRename reports support for the posix-rename@openssh.com extension.
+	// The handler must also implement PosixRenamer.
+	PosixRename bool
+
+	// StatVFS reports support for the statvfs@openssh.com extension. The
+	// handler must also implement StatVFSer.
+	StatVFS bool
+}
+
+// CapabilityReporter may optionally be implemented by a RequestHandler to
+// report which optional operations it supports. Handlers which do not
+// implement it are assumed to support symlinks, and to support each extension
+// whose interface they implement.
+type CapabilityReporter interface {
+	Capabilities() Capabilities
+}
+
+// handlerCapabilities determines the capabilities of the given handler. A
+// capability is never reported if the handler lacks the interface needed to
+// serve it.
+func handlerCapabilities(h RequestHandler) Capabilities {
+	caps := Capabilities{Symlinks: true, PosixRename: true, StatVFS: true}
+	if reporter, ok := h.(CapabilityReporter); ok {
+		caps = reporter.Capabilities()
+	}
+	if _, ok := h.(PosixRenamer); !ok {
+		caps.PosixRename = false
+	}
+	if _, ok := h.(StatVFSer); !ok {
+		caps.StatVFS = false
+	}
+	return caps
+}
@@ -5,6 +5,8 @@ import (
 	"io"
 	"os"
 	"syscall"
+
+	"github.com/pkg/errors"
 )
 
 // Error types that match the SFTP's SSH_FXP_STATUS codes. Gives you more
@@ -26,7 +28,7 @@ const (
 	// Newer error codes
 	// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-13#section-9.1
 	fxInvalidHandle           = 9
-	fxNoSuchPath              = 10 // I think this is identical to SSH_FX_NO_SUCH_FILE but also can mean "invalid path"
+	fxNoSuchPath              = 10 // a parent directory of the path does not exist
 	fxFileAlreadyExists       = 11
 	fxWriteProtected          = 12
 	fxNoMedia                 = 13
@@ -60,6 +62,12 @@ const (
 	// directly translates to SSH_FX_NO_SUCH_FILE.
 	ErrNoSuchFile = fxerr(fxNoSuchFile)
 
+	// ErrNoSuchPath means a reference was made to a path whose parent
+	// directory does not exist, i.e. the path itself is invalid; directly
+	// translates to SSH_FX_NO_SUCH_PATH. Use ErrNoSuchFile if only the final
+	// path component is missing.
+	ErrNoSuchPath = fxerr(fxNoSuchPath)
+
 	// ErrPermDenied means the client does not have sufficient permissions to
 	// perform the operation; directly translates to SSH_FX_PERMISSION_DENIED.
 	ErrPermDenied = fxerr(fxPermissionDenied)
@@ -100,6 +108,24 @@ const (
 	// reason, e.g., it is on read-only media; directly translates to
 	// SSH_FX_WRITE_PROTECT.
 	ErrWriteProtected = fxerr(fxWriteProtected)
+
+	// ErrFileAlreadyExists indicates that the given path already exists when
+	// it must not; directly translates to SSH_FX_FILE_ALREADY_EXISTS.
+	ErrFileAlreadyExists = fxerr(fxFileAlreadyExists)
+
+	// ErrDirNotEmpty indicates that a directory could not be removed because
+	// it has children; directly translates to SSH_FX_DIR_NOT_EMPTY.
+	ErrDirNotEmpty = fxerr(fxDirNotEmpty)
+
+	// ErrLinkLoop indicates that too many symbolic links were encountered, or
+	// that a symbolic link was encountered where none may be followed;
+	// directly translates to SSH_FX_LINK_LOOP.
+	ErrLinkLoop = fxerr(fxLinkLoop)
+
+	// ErrInvalidFilename indicates that a path component is not a valid file
+	// name, e.g. because it is too long; directly translates to
+	// SSH_FX_INVALID_FILENAME.
+	ErrInvalidFilename = fxerr(fxInvalidFilename)
 )
 
 func (e fxerr) Error() string {
@@ -110,10 +136,14 @@ func (e fxerr) Error() string {
 		return "EOF"
 	case ErrNoSuchFile:
 		return "No Such File"
+	case ErrNoSuchPath:
+		return "No Such Path"
 	case ErrPermDenied:
 		return "Permission Denied"
 	case ErrBadMessage:
 		return "Bad Message"
+	case fxInvalidHandle:
+		return "Invalid Handle"
 	case ErrNoConnection:
 		return "No Connection"
 	case ErrConnectionLost:
@@ -124,6 +154,14 @@ func (e fxerr) Error() string {
 		return "Not a Directory"
 	case ErrIsADirectory:
 		return "Is a Directory"
+	case ErrFileAlreadyExists:
+		return "File Already Exists"
+	case ErrDirNotEmpty:
+		return "Directory Not Empty"
+	case ErrLinkLoop:
+		return "Link Loop"
+	case ErrInvalidFilename:
+		return "Invalid Filename"
 	default:
 		return "Failure"
 	}
@@ -143,7 +181,9 @@ func (e fxerr) WithMessagef(format string, args ...interface{}) error {
 
 // A Status is an SFTP-defined type for conveying errors as well as success replies
 // with no data. Status is exported so RequestHandler implementations may use it
-// for more complete control over what gets sent back to the client.
+// for more complete control over what gets sent back to the client; it is also
+// exactly what is embedded in SSH_FXP_STATUS packets. Handlers may return a
+// *Status directly or wrapped, e.g. with github.com/pkg/errors.
 //
 // https://tools.ietf.org/pdf/draft-ietf-secsh-filexfer-02.pdf#38
 type Status struct {
@@ -152,6 +192,13 @@ type Status struct {
 	Lang string // Optional ISO 639 language tag for Msg
 }
 
+// Is reports whether the target is the error code of this Status, such that
+// errors.Is(ErrNoSuchFile.WithMessage("..."), ErrNoSuchFile) holds.
+func (s *Status) Is(target error) bool {
+	code, ok := target.(fxerr)
+	return ok && uint32(code) == s.Code
+}
+
 func (s *Status) Error() string {
 	if s.Msg == "" {
 		return fmt.Sprintf("sftp: %s", fxerr(s.Code))
@@ -161,6 +208,12 @@ func (s *Status) Error() string {
 
 // translateErrno translates a syscall error number to an SFTP error code.
 func translateErrno(errno syscall.Errno) uint32 {
+	// EEXIST is checked separately since it equals ENOTEMPTY on some OSs,
+	// e.g. AIX, where the two cannot be told apart
+	if errno == syscall.EEXIST && errno != syscall.ENOTEMPTY {
+		return fxFileAlreadyExists
+	}
+
 	switch errno {
 	case 0:
 		return fxOK
@@ -170,6 +223,14 @@ func translateErrno(errno syscall.Errno) uint32 {
 		return fxPermissionDenied
 	case syscall.ENOTDIR:
 		return fxNotADirectory
+	case syscall.EISDIR:
+		return fxIsADirectory
+	case syscall.ELOOP:
+		return fxLinkLoop
+	case syscall.ENOSPC:
+		return fxNoSpaceOnFilesystem
+	case syscall.EDQUOT:
+		return fxQuotaExceeded
 	case syscall.ENOTEMPTY:
 		return fxDirNotEmpty
 		// TODO(samterainsights): there are definitely more 1-to-1 mappings we can include
@@ -178,42 +239,63 @@ func translateErrno(errno syscall.Errno) uint32 {
 	return fxFailure
 }
 
-func statusFromError(p ider, err error) *fxpStatusPkt {
-	if status, ok := err.(*Status); ok {
-		return &fxpStatusPkt{p.id(), *status}
+// StatusFromError converts an arbitrary error into the Status which would be
+// sent to the client in reply to a request which failed with that error. A nil
+// error produces a Status with the SSH_FX_OK code.
+func StatusFromError(err error) *Status {
+	if err == nil {
+		// Some clients display the message even on success
+		return &Status{Code: fxOK, Msg: "Success", Lang: "en"}
 	}
 
-	ret := &fxpStatusPkt{
-		ID: p.id(),
-		Status: Status{
-			Code: fxOK,
-		},
-	}
-	if err == nil {
-		return ret
+	var status *Status
+	if errors.As(err, &status) {
+		return status
 	}
 
 	debug("statusFromError[type=%T val=%#v msg=%q]", err, err, err.Error())
-	ret.Status.Code = fxFailure
-	ret.Status.Msg = err.Error()
+	ret := &Status{
+		Code: fxFailure,
+		Msg:  err.Error(),
+	}
 
-	switch e := err.(type) {
+	switch e := errors.Cause(err).(type) {
 	case syscall.Errno:
-		ret.Status.Code = translateErrno(e)
+		ret.Code = translateErrno(e)
 	case *os.PathError:
 		if errno, ok := e.Err.(syscall.Errno); ok {
-			ret.Status.Code = translateErrno(errno)
+			ret.Code = translateErrno(errno)
 		}
 	case fxerr:
-		ret.Status.Code = uint32(e)
+		ret.Code = uint32(e)
 	default:
-		switch e {
-		case io.EOF:
-			ret.Status.Code = fxEOF
-		case os.ErrNotExist:
-			ret.Status.Code = fxNoSuchFile
+		var errno syscall.Errno
+		switch {
+		case e == io.EOF:
+			ret.Code = fxEOF
+		case errors.As(err, &errno):
+			// e.g. *os.LinkError, *os.SyscallError, or wrapped with %w
+			ret.Code = translateErrno(errno)
+		}
+	}
+
+	if ret.Code == fxFailure {
+		// Fall back to the standard sentinels, which are also matched by
+		// errors such as fs.ErrNotExist, or errnos with no direct mapping,
+		// e.g. EACCES
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			ret.Code = fxNoSuchFile
+		case errors.Is(err, os.ErrPermission):
+			ret.Code = fxPermissionDenied
+		case errors.Is(err, os.ErrExist):
+			ret.Code = fxFileAlreadyExists
 		}
 	}
 
 	return ret
 }
+
+func statusFromError(p ider, err error) *fxpStatusPkt {
+	return &fxpStatusPkt{p.id(), *StatusFromError(err)}
+}
@@ -0,0 +1,39 @@
+// memfs-write-benchmark benchmarks the performance of uploading a large file to
+// sftp.MemFS as a stream of small sequential writes, as clients send them.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/tera-insights/sftp"
+)
+
+var (
+	SIZE  = flag.Int("size", 64<<20, "size of the file to write")
+	CHUNK = flag.Int("chunk", 1<<15, "size of each write")
+)
+
+func init() {
+	flag.Parse()
+}
+
+func main() {
+	f, err := sftp.MemFS().OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	chunk := make([]byte, *CHUNK)
+	log.Printf("writing %d bytes in chunks of %d", *SIZE, *CHUNK)
+	t1 := time.Now()
+	for off := 0; off < *SIZE; off += len(chunk) {
+		if _, err := f.WriteAt(chunk, int64(off)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("wrote %d bytes in %s", f.Size(), time.Since(t1))
+}
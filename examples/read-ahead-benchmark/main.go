@@ -0,0 +1,106 @@
+// read-ahead-benchmark compares the throughput of reading a file sequentially
+// from a backend with high read latency, with and without sftp.ReadAhead. The
+// server and client run in-process, connected by a pipe, and the client sends
+// one read request at a time, as simple clients do, waiting the given network
+// round-trip time before each one. Reading ahead overlaps that time with the
+// latency of the backend.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	psftp "github.com/pkg/sftp"
+	"github.com/tera-insights/sftp"
+)
+
+var (
+	SIZE    = flag.Int("size", 4<<20, "size of the file to read")
+	LATENCY = flag.Duration("latency", 5*time.Millisecond, "latency of each read from the backend")
+	RTT     = flag.Duration("rtt", 5*time.Millisecond, "network round-trip time added to each read request")
+)
+
+func init() {
+	flag.Parse()
+}
+
+// slowHandler serves files whose reads take at least the given latency.
+type slowHandler struct {
+	sftp.RequestHandler
+	latency   time.Duration
+	readAhead bool
+}
+
+func (h slowHandler) OpenFile(name string, flag int, perm os.FileMode) (sftp.FileHandle, error) {
+	f, err := h.RequestHandler.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	var slow sftp.FileHandle = slowFile{f, h.latency}
+	if h.readAhead {
+		slow = sftp.ReadAhead(slow)
+	}
+	return slow, nil
+}
+
+type slowFile struct {
+	sftp.FileHandle
+	latency time.Duration
+}
+
+func (f slowFile) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(f.latency)
+	return f.FileHandle.ReadAt(p, off)
+}
+
+func main() {
+	content := make([]byte, *SIZE)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	files := map[string][]byte{"/file": content}
+
+	for _, readAhead := range []bool{false, true} {
+		h := slowHandler{sftp.ReadOnlyFS(files), *LATENCY, readAhead}
+		log.Printf("read ahead %v: read %d bytes in %s", readAhead, *SIZE, timeRead(h))
+	}
+}
+
+// timeRead serves the handler over a pipe and times reading /file from it.
+func timeRead(h sftp.RequestHandler) time.Duration {
+	clientConn, serverConn := net.Pipe()
+	go sftp.ServeWithOpts(serverConn, h, sftp.ServerOpts{})
+	defer serverConn.Close()
+
+	c, err := psftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		log.Fatalf("unable to start sftp session: %v", err)
+	}
+	defer c.Close()
+
+	f, err := c.Open("/file")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	// Read one packet at a time, since io.Copy would send many requests at
+	// once, hiding the latency of the backend
+	buf := make([]byte, 1<<15)
+	t1 := time.Now()
+	for {
+		time.Sleep(*RTT)
+		_, err := f.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return time.Since(t1)
+}
@@ -0,0 +1,184 @@
+package sftp
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// extension describes an SSH_FXP_EXTENDED request supported by the server. The
+// registry of extensions is the single source of truth for both decoding
+// extended requests and advertising them in SSH_FXP_VERSION.
+type extension struct {
+	data string // advertised alongside the extension name in SSH_FXP_VERSION
+
+	// op, if set, is the type of standard request of which the extension is
+	// a variant, such that disabling that type disables the extension too.
+	op fxp
+
+	// serverData, if set, computes the data to advertise for the given server
+	// instead, for extensions whose data depends on its options.
+	serverData func(*server) string
+
+	// decode unmarshals the extension-specific request data.
+	decode func(id uint32, data []byte) (requestPacket, error)
+
+	// supported reports whether the given server, as configured and with its
+	// handler, supports the extension. If nil, the extension is always
+	// supported.
+	supported func(*server) bool
+}
+
+var (
+	extensionsMtx sync.RWMutex
+	extensions    = make(map[string]extension)
+)
+
+func init() {
+	registerExtension("posix-rename@openssh.com", extension{
+		data: "1",
+		op:   fxpRename,
+		decode: func(id uint32, data []byte) (requestPacket, error) {
+			pkt := &fxpExtPosixRenamePkt{ID: id}
+			return pkt, pkt.UnmarshalBinary(data)
+		},
+		supported: func(s *server) bool {
+			return s.caps.PosixRename
+		},
+	})
+	registerExtension("statvfs@openssh.com", extension{
+		data: "2",
+		decode: func(id uint32, data []byte) (requestPacket, error) {
+			pkt := &fxpExtStatvfsPkt{ID: id}
+			return pkt, pkt.UnmarshalBinary(data)
+		},
+		supported: func(s *server) bool {
+			return s.caps.StatVFS
+		},
+	})
+	registerExtension("users-groups-by-id@openssh.com", extension{
+		data: "1",
+		decode: func(id uint32, data []byte) (requestPacket, error) {
+			pkt := &fxpExtUsersGroupsByIDPkt{ID: id}
+			return pkt, pkt.UnmarshalBinary(data)
+		},
+	})
+	registerExtension("home-directory", extension{
+		data: "1",
+		decode: func(id uint32, data []byte) (requestPacket, error) {
+			pkt := &fxpExtHomeDirectoryPkt{ID: id}
+			return pkt, pkt.UnmarshalBinary(data)
+		},
+		supported: func(s *server) bool {
+			return s.WorkDir != ""
+		},
+	})
+	registerExtension("vendor-id", extension{
+		decode: func(id uint32, data []byte) (requestPacket, error) {
+			pkt := &fxpExtVendorIDPkt{ID: id}
+			return pkt, pkt.UnmarshalBinary(data)
+		},
+		serverData: func(s *server) string {
+			id := s.vendorID()
+			return string(appendVendorID(make([]byte, 0, id.encodedSize()), id))
+		},
+	})
+}
+
+func registerExtension(name string, ext extension) {
+	extensionsMtx.Lock()
+	defer extensionsMtx.Unlock()
+	if _, exists := extensions[name]; exists {
+		panic(fmt.Sprintf("sftp: extension %q registered twice", name))
+	}
+	extensions[name] = ext
+}
+
+// An ExtensionHandlerFunc handles a custom SSH_FXP_EXTENDED request, given the
+// session's RequestHandler and the raw extension-specific request data.
+//
+// If the returned error is non-nil, it is sent to the client as a status. Else
+// if the reply is non-nil, it is sent verbatim as the extension-specific data
+// of an SSH_FXP_EXTENDED_REPLY. Otherwise an SSH_FX_OK status is sent.
+type ExtensionHandlerFunc func(handler RequestHandler, data []byte) (reply []byte, err error)
+
+// RegisterExtension registers a custom extended request with the given name,
+// which should be of the form "name@domain". The data is advertised alongside
+// the name in SSH_FXP_VERSION and is typically a version number. Requests with
+// the given name are passed to fn. RegisterExtension panics if an extension
+// with the same name has already been registered; it is intended to be called
+// from init functions.
+func RegisterExtension(name, data string, fn ExtensionHandlerFunc) {
+	registerExtension(name, extension{
+		data: data,
+		decode: func(id uint32, data []byte) (requestPacket, error) {
+			pkt := &fxpExtCustomPkt{ID: id, handle: fn}
+			return pkt, pkt.UnmarshalBinary(data)
+		},
+	})
+}
+
+// supportedExtensions lists the extensions to advertise for the given server,
+// sorted by name.
+func supportedExtensions(s *server) []Extension {
+	extensionsMtx.RLock()
+	defer extensionsMtx.RUnlock()
+
+	var exts []Extension
+	for name, ext := range extensions {
+		if s.disabledOps[fxpExtended] || ext.op != 0 && s.disabledOps[ext.op] {
+			continue
+		}
+		if s.extensionAllowed(name) && (ext.supported == nil || ext.supported(s)) {
+			data := ext.data
+			if ext.serverData != nil {
+				data = ext.serverData(s)
+			}
+			exts = append(exts, Extension{name, data})
+		}
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		return exts[i].Name < exts[j].Name
+	})
+	return exts
+}
+
+// extensionAllowed reports whether ServerOpts.AllowedExtensions permits the
+// extended request with the given name.
+func (s *server) extensionAllowed(name string) bool {
+	return s.allowedExts == nil || s.allowedExts[name]
+}
+
+// stringSet converts a slice to a set, preserving nil.
+func stringSet(strs []string) map[string]bool {
+	if strs == nil {
+		return nil
+	}
+	set := make(map[string]bool, len(strs))
+	for _, str := range strs {
+		set[str] = true
+	}
+	return set
+}
+
+// decodeExtended decodes an SSH_FXP_EXTENDED request using the registered
+// extensions. If the extension is unknown or not allowed by the given func, the
+// generic *fxpExtendedPkt is returned along with errUnknownExtendedPacket.
+func decodeExtended(b []byte, allowed func(name string) bool) (requestPacket, error) {
+	pkt := &fxpExtendedPkt{}
+	if err := pkt.UnmarshalBinary(b); err != nil {
+		return pkt, err
+	}
+	if !allowed(pkt.RequestName) {
+		return pkt, errUnknownExtendedPacket
+	}
+
+	extensionsMtx.RLock()
+	ext, exists := extensions[pkt.RequestName]
+	extensionsMtx.RUnlock()
+
+	if !exists {
+		return pkt, errUnknownExtendedPacket
+	}
+	return ext.decode(pkt.ID, pkt.RequestData)
+}
@@ -0,0 +1,96 @@
+package sftp
+
+import (
+	"sync"
+)
+
+// fairQueueLimit is the number of read and write requests a fairQueue holds
+// before refusing more, so that clients still feel backpressure.
+const fairQueueLimit = 8 * sftpServerWorkerCount
+
+// fairQueue queues read and write requests per handle, and yields them
+// round-robin across handles, so that a transfer with many requests
+// outstanding cannot starve others. Requests on the same handle are yielded in
+// the order they were pushed.
+type fairQueue struct {
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	queues  map[string][]orderedRequest
+	handles []string // those with queued requests, in the order to serve them
+	queued  int
+	closed  bool
+}
+
+func newFairQueue() *fairQueue {
+	q := &fairQueue{queues: make(map[string][]orderedRequest)}
+	q.cond = sync.NewCond(&q.mtx)
+	return q
+}
+
+// push queues a request on the given handle, waiting while the queue is full.
+func (q *fairQueue) push(handle string, pkt orderedRequest) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for q.queued >= fairQueueLimit {
+		q.cond.Wait()
+	}
+	if len(q.queues[handle]) == 0 {
+		q.handles = append(q.handles, handle)
+	}
+	q.queues[handle] = append(q.queues[handle], pkt)
+	q.queued++
+	q.cond.Broadcast()
+}
+
+// pop returns the next request, waiting while the queue is empty. It returns
+// false once the queue is closed and empty.
+func (q *fairQueue) pop() (orderedRequest, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for q.queued == 0 {
+		if q.closed {
+			return orderedRequest{}, false
+		}
+		q.cond.Wait()
+	}
+
+	handle := q.handles[0]
+	q.handles = q.handles[1:]
+	pkt, rest := q.queues[handle][0], q.queues[handle][1:]
+	if len(rest) > 0 {
+		q.queues[handle] = rest
+		q.handles = append(q.handles, handle) // back of the line
+	} else {
+		delete(q.queues, handle)
+	}
+	q.queued--
+	q.cond.Broadcast()
+	return pkt, true
+}
+
+// close makes pop return false once the queue is empty.
+func (q *fairQueue) close() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// rwHandle returns the handle of a read or write request.
+func rwHandle(pkt requestPacket) (string, bool) {
+	switch pkt := pkt.(type) {
+	case *fxpReadPkt:
+		return pkt.Handle, true
+	case *fxpWritePkt:
+		return pkt.Handle, true
+	}
+	return "", false
+}
+
+// mayReorder reports whether the replies to the given requests may be sent in
+// either order, i.e. they are reads or writes on different handles.
+func mayReorder(a, b requestPacket) bool {
+	ha, aok := rwHandle(a)
+	hb, bok := rwHandle(b)
+	return aok && bok && ha != hb
+}
@@ -0,0 +1,72 @@
+package sftp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// FuzzFileAttrRoundTrip checks that any FileAttr which can be sent on the wire
+// is decoded by takeAttr exactly as appendAttr encoded it, consuming the
+// encoded size and nothing more. Its seed corpus is in testdata/fuzz.
+func FuzzFileAttrRoundTrip(f *testing.F) {
+	f.Add(uint32(0), uint64(0), uint32(0), uint32(0), uint32(0), uint32(0), uint32(0), "", "", uint8(0))
+	f.Add(uint32(AttrFlagSize|AttrFlagUIDGID|AttrFlagPermissions|AttrFlagAcModTime|AttrFlagExtended),
+		uint64(1<<40), uint32(1000), uint32(100), uint32(0100644), uint32(1e9), uint32(2e9), "name@example.com", "data", uint8(2))
+
+	f.Fuzz(func(t *testing.T, flags uint32, size uint64, uid, gid, mode, atime, mtime uint32, extName, extData string, extCount uint8) {
+		attr := &FileAttr{
+			Flags:   attrFlag(flags),
+			Size:    size,
+			UID:     uid,
+			GID:     gid,
+			Perms:   toFileMode(mode),
+			AcTime:  time.Unix(int64(atime), 0),
+			ModTime: time.Unix(int64(mtime), 0),
+		}
+		for i := uint8(0); i < extCount%8; i++ {
+			attr.Extensions = append(attr.Extensions, Extension{extName, extData})
+		}
+
+		b := appendAttr(nil, attr)
+		if len(b) != attr.encodedSize() {
+			t.Fatalf("encoded %d bytes, but encodedSize() = %d", len(b), attr.encodedSize())
+		}
+		got, rest, err := takeAttr(append(b, "trailing"...))
+		if err != nil {
+			t.Fatalf("takeAttr(%x): %v", b, err)
+		}
+		if string(rest) != "trailing" {
+			t.Fatalf("takeAttr(%x) left %q, want %q", b, rest, "trailing")
+		}
+		if !got.Equal(attr) {
+			t.Fatalf("takeAttr(appendAttr(%+v)) = %+v", attr, got)
+		}
+		if again := appendAttr(nil, got); !bytes.Equal(again, b) {
+			t.Fatalf("re-encoded as %x, want %x", again, b)
+		}
+	})
+}
+
+// FuzzTakeAttr checks that takeAttr never panics on arbitrary input, and that
+// when it succeeds it consumes exactly the encoded size of what it decoded. Its
+// seed corpus is in testdata/fuzz.
+func FuzzTakeAttr(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(appendAttr(nil, &FileAttr{
+		Flags:      AttrFlagSize | AttrFlagExtended,
+		Size:       42,
+		Extensions: []Extension{{"name", "data"}},
+	}))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		attr, rest, err := takeAttr(b)
+		if err != nil {
+			return
+		}
+		if consumed := len(b) - len(rest); consumed != attr.encodedSize() {
+			t.Fatalf("takeAttr(%x) consumed %d bytes, but decoded %+v with encodedSize() = %d",
+				b, consumed, attr, attr.encodedSize())
+		}
+	})
+}
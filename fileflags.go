@@ -0,0 +1,49 @@
+package sftp
+
+import (
+	"strconv"
+)
+
+// FileFlagsExtension is the name of the FileAttr extension which carries a
+// file's platform-specific flags, e.g. the immutable or append-only bits set
+// via chattr(1) on Linux or chflags(1) on BSDs. The data is the flags as a
+// decimal integer, interpreted as st_flags on BSDs and as the FS_IOC_GETFLAGS
+// bits on Linux.
+//
+// HostFS applies this extension in Setstat where supported and otherwise
+// ignores it. Flags are only reported in stat replies on BSDs, where they are
+// available from stat(2) at no extra cost.
+const FileFlagsExtension = "file-flags@tera-insights.com"
+
+// fileFlagsFromAttr extracts the file flags extension from the given attributes
+// if present.
+func fileFlagsFromAttr(attr *FileAttr) (flags uint32, ok bool, err error) {
+	if attr.Flags&AttrFlagExtended == 0 {
+		return 0, false, nil
+	}
+	for _, ext := range attr.Extensions {
+		if ext.Name == FileFlagsExtension {
+			v, err := strconv.ParseUint(ext.Data, 10, 32)
+			if err != nil {
+				return 0, false, ErrBadMessage.WithMessagef("invalid %s: %q", FileFlagsExtension, ext.Data)
+			}
+			return uint32(v), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// applyFileFlags sets the file flags of the given path if they are specified
+// in the given attributes.
+func applyFileFlags(name string, attr *FileAttr) error {
+	flags, ok, err := fileFlagsFromAttr(attr)
+	if !ok {
+		return err
+	}
+	return setFileFlags(name, flags)
+}
+
+// fileFlagsExtension encodes the given flags as a FileAttr extension.
+func fileFlagsExtension(flags uint32) Extension {
+	return Extension{FileFlagsExtension, strconv.FormatUint(uint64(flags), 10)}
+}
@@ -0,0 +1,22 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package sftp
+
+import (
+	"syscall"
+)
+
+func setFileFlags(name string, flags uint32) error {
+	err := syscall.Chflags(name, int(flags))
+	if err == syscall.EOPNOTSUPP {
+		return nil // filesystem doesn't support flags
+	}
+	return err
+}
+
+func fileFlagsFromSys(sys interface{}) (uint32, bool) {
+	if stat, ok := sys.(*syscall.Stat_t); ok {
+		return uint32(stat.Flags), true
+	}
+	return 0, false
+}
@@ -0,0 +1,25 @@
+package sftp
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func setFileFlags(name string, flags uint32) error {
+	f, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags))
+	if err == unix.ENOTTY || err == unix.EOPNOTSUPP {
+		return nil // filesystem doesn't support flags
+	}
+	return err
+}
+
+func fileFlagsFromSys(sys interface{}) (uint32, bool) {
+	return 0, false // requires an ioctl, too expensive to do on every stat
+}
@@ -0,0 +1,11 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package sftp
+
+func setFileFlags(name string, flags uint32) error {
+	return nil // unsupported; ignore
+}
+
+func fileFlagsFromSys(sys interface{}) (uint32, bool) {
+	return 0, false
+}
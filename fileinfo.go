@@ -0,0 +1,99 @@
+package sftp
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// NewFileInfo returns an os.FileInfo with the given properties, for handlers
+// which have no os.FileInfo of their own to return from Stat, Lstat or a
+// DirReader, e.g. those backed by a database. Its Sys method returns the
+// equivalent *FileAttr, which the server sends to clients as-is.
+func NewFileInfo(name string, size int64, mode os.FileMode, mtime time.Time) os.FileInfo {
+	return &fileInfo{
+		name: path.Base(name),
+		attr: FileAttr{
+			Flags:   AttrFlagSize | AttrFlagPermissions | AttrFlagAcModTime,
+			Size:    uint64(size),
+			Perms:   mode,
+			AcTime:  mtime,
+			ModTime: mtime,
+		},
+	}
+}
+
+// NewFileInfoWithOwner is identical to NewFileInfo but also reports the user
+// and group IDs of the file's owner.
+func NewFileInfoWithOwner(name string, size int64, mode os.FileMode, mtime time.Time, uid, gid uint32) os.FileInfo {
+	fi := NewFileInfo(name, size, mode, mtime).(*fileInfo)
+	fi.attr.Flags |= AttrFlagUIDGID
+	fi.attr.UID = uid
+	fi.attr.GID = gid
+	return fi
+}
+
+// sizedFileInfo overrides the size of an os.FileInfo, including in the
+// *FileAttr returned by Sys, if any.
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi sizedFileInfo) Size() int64 { return fi.size }
+
+func (fi sizedFileInfo) attrExtensions() []Extension { return fileInfoExtensions(fi.FileInfo) }
+
+func (fi sizedFileInfo) inode() (uint64, bool) { return fileInode(fi.FileInfo) }
+
+func (fi sizedFileInfo) Sys() interface{} {
+	if attr, ok := fi.FileInfo.Sys().(*FileAttr); ok {
+		sized := *attr
+		sized.Flags |= AttrFlagSize
+		sized.Size = uint64(fi.size)
+		return &sized
+	}
+	return fi.FileInfo.Sys()
+}
+
+// extendedFileInfo attaches FileAttr extensions to an os.FileInfo whose Sys
+// method describes the file otherwise, e.g. a *syscall.Stat_t.
+type extendedFileInfo struct {
+	os.FileInfo
+	exts []Extension
+}
+
+func (fi extendedFileInfo) attrExtensions() []Extension { return fi.exts }
+
+func (fi extendedFileInfo) inode() (uint64, bool) { return fileInode(fi.FileInfo) }
+
+// attrExtender is implemented by os.FileInfos carrying FileAttr extensions,
+// including wrappers which forward those of the os.FileInfo they wrap.
+type attrExtender interface {
+	attrExtensions() []Extension
+}
+
+// fileInfoExtensions returns the FileAttr extensions attached to fi, if any.
+func fileInfoExtensions(fi os.FileInfo) []Extension {
+	if x, ok := fi.(attrExtender); ok {
+		return x.attrExtensions()
+	}
+	return nil
+}
+
+type fileInfo struct {
+	name string
+	attr FileAttr
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.attr.Size) }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.attr.Perms }
+func (fi *fileInfo) ModTime() time.Time { return fi.attr.ModTime }
+func (fi *fileInfo) IsDir() bool        { return fi.attr.Perms.IsDir() }
+
+// Sys returns a copy of the file's attributes, so callers cannot modify them.
+func (fi *fileInfo) Sys() interface{} {
+	attr := fi.attr
+	return &attr
+}
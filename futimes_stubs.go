@@ -0,0 +1,14 @@
+// +build windows plan9 js aix
+
+package sftp
+
+import (
+	"os"
+	"time"
+)
+
+// fileChtimes changes the access and modification times of an open file. This
+// OS has no futimes(2), so the file's path is used instead.
+func fileChtimes(f *os.File, atime, mtime time.Time) error {
+	return os.Chtimes(f.Name(), atime, mtime)
+}
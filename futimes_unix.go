@@ -0,0 +1,21 @@
+// +build !windows,!plan9,!js,!aix
+
+package sftp
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileChtimes changes the access and modification times of an open file,
+// without looking up its path again.
+func fileChtimes(f *os.File, atime, mtime time.Time) error {
+	return retryEINTR(func() error {
+		return unix.Futimes(int(f.Fd()), []unix.Timeval{
+			unix.NsecToTimeval(atime.UnixNano()),
+			unix.NsecToTimeval(mtime.UnixNano()),
+		})
+	})
+}
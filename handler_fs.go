@@ -0,0 +1,398 @@
+// +build go1.16
+
+package sftp
+
+// A RequestHandler adapting an io/fs filesystem, e.g. os.DirFS or an embed.FS,
+// which is read-only unless the filesystem implements WritableFS.
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FSHandler creates a RequestHandler serving the given fs.FS. Since an fs.FS
+// cannot name anything outside of itself, this is a simple way to confine
+// clients to a directory tree with os.DirFS, or to serve an embed.FS.
+//
+// SFTP paths are mapped onto the fs.FS by treating "/" as its root. Symbolic
+// links are supported if fsys has ReadLink and Lstat methods, as fs.ReadLinkFS
+// does. Unless fsys implements WritableFS, all requests which would modify the
+// filesystem fail with ErrPermDenied.
+func FSHandler(fsys fs.FS) RequestHandler {
+	return fsHandler{fsys}
+}
+
+type fsHandler struct {
+	fsys fs.FS
+}
+
+// WritableFS is an fs.FS which can also be modified. If the fs.FS passed to
+// FSHandler implements it, clients may upload files, create directories, and
+// remove and rename files and directories. Names are in the same unrooted,
+// slash-separated form as for fs.FS.
+type WritableFS interface {
+	fs.FS
+
+	// OpenFileWrite opens the named file for writing as os.OpenFile does. The
+	// flag always includes os.O_WRONLY or os.O_RDWR.
+	OpenFileWrite(name string, flag int, perm fs.FileMode) (WritableFile, error)
+
+	// Mkdir creates a directory as os.Mkdir does.
+	Mkdir(name string, perm fs.FileMode) error
+
+	// Remove removes a file or empty directory as os.Remove does.
+	Remove(name string) error
+
+	// Rename renames a file or directory. It should fail if newname exists.
+	Rename(oldname, newname string) error
+}
+
+// WritableFile is a file opened by WritableFS.OpenFileWrite. Write is only used
+// for files opened with os.O_APPEND, as for *os.File.
+type WritableFile interface {
+	fs.File
+	io.Writer
+	io.WriterAt
+}
+
+// WritableDirFS returns a WritableFS for the tree rooted at the given
+// directory, extending os.DirFS with writes. As with os.DirFS, names
+// containing ".." cannot escape the root, but symbolic links within it which
+// point outside of it are followed. Symbolic links themselves can be read and
+// removed, as it also implements the Lstat and ReadLink methods of
+// fs.ReadLinkFS.
+func WritableDirFS(root string) WritableFS {
+	return writableDirFS{os.DirFS(root), root}
+}
+
+type writableDirFS struct {
+	fs.FS
+	root string
+}
+
+// join converts a name into an OS path under the root, or fails with an
+// *fs.PathError as os.DirFS does.
+func (d writableDirFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(d.root, filepath.FromSlash(name)), nil
+}
+
+// hidePath replaces the OS path in an error with the given name, as os.DirFS
+// does, so as not to reveal the root to clients.
+func (d writableDirFS) hidePath(name string, err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return &fs.PathError{Op: e.Op, Path: name, Err: e.Err}
+	case *os.LinkError:
+		return &fs.PathError{Op: e.Op, Path: name, Err: e.Err}
+	}
+	return err
+}
+
+func (d writableDirFS) OpenFileWrite(name string, flag int, perm fs.FileMode) (WritableFile, error) {
+	full, err := d.join("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(full, flag, perm)
+	if err != nil {
+		return nil, d.hidePath(name, err)
+	}
+	return f, nil
+}
+
+func (d writableDirFS) Mkdir(name string, perm fs.FileMode) error {
+	full, err := d.join("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return checkParent(full, d.hidePath(name, os.Mkdir(full, perm)))
+}
+
+func (d writableDirFS) Remove(name string) error {
+	full, err := d.join("remove", name)
+	if err != nil {
+		return err
+	}
+	return d.hidePath(name, os.Remove(full))
+}
+
+// Lstat returns info about the named file without following symbolic links.
+func (d writableDirFS) Lstat(name string) (fs.FileInfo, error) {
+	full, err := d.join("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Lstat(full)
+	return fi, d.hidePath(name, err)
+}
+
+// ReadLink returns the target of the named symbolic link.
+func (d writableDirFS) ReadLink(name string) (string, error) {
+	full, err := d.join("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	target, err := os.Readlink(full)
+	return target, d.hidePath(name, err)
+}
+
+func (d writableDirFS) Rename(oldname, newname string) error {
+	oldfull, err := d.join("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newfull, err := d.join("rename", newname)
+	if err != nil {
+		return err
+	}
+	// Racy, but the OS offers no portable way to rename without replacing
+	if _, err := os.Lstat(newfull); err == nil {
+		return ErrFileAlreadyExists
+	}
+	return checkParent(newfull, d.hidePath(oldname, os.Rename(oldfull, newfull)))
+}
+
+// readLinkFS matches fs.ReadLinkFS, which is only available from Go 1.25.
+type readLinkFS interface {
+	ReadLink(name string) (string, error)
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// fsName converts an SFTP path into the unrooted form fs.FS requires. Cleaning
+// the rooted path first means ".." can never escape the root.
+func fsName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// OpenFile should behave identically to os.OpenFile.
+func (h fsHandler) OpenFile(name string, flag int, perm os.FileMode) (FileHandle, error) {
+	var f fs.File
+	var err error
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		f, err = h.fsys.Open(fsName(name))
+	} else if wfs, ok := h.fsys.(WritableFS); !ok {
+		return nil, ErrPermDenied
+	} else {
+		if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+			flag |= os.O_RDWR // e.g. O_CREATE alone, which must still create
+		}
+		f, err = wfs.OpenFileWrite(fsName(name), flag, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, ErrIsADirectory
+	}
+	return &fsFile{FileInfo: fi, raw: f, append: flag&os.O_APPEND != 0}, nil
+}
+
+// Mkdir creates a new directory. An error should be returned if the specified
+// path already exists.
+func (h fsHandler) Mkdir(name string, attr *FileAttr) error {
+	if wfs, ok := h.fsys.(WritableFS); ok {
+		return wfs.Mkdir(fsName(name), attr.Perms&os.ModePerm)
+	}
+	return ErrPermDenied
+}
+
+// OpenDir opens a directory for scanning. An error should be returned if the
+// given path is not a directory. If the returned DirReader can be cast to an
+// io.Closer, its Close method will be called once the SFTP client is done
+// scanning.
+func (h fsHandler) OpenDir(name string) (DirReader, error) {
+	f, err := h.fsys.Open(fsName(name))
+	if err != nil {
+		return nil, err
+	}
+	// Files may implement fs.ReadDirFile too, e.g. *os.File
+	d, ok := f.(fs.ReadDirFile)
+	if fi, err := f.Stat(); err != nil || !ok || !fi.IsDir() {
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrNotADirectory
+	}
+	return fsDir{d}, nil
+}
+
+// Rename renames the given path. An error should be returned if the path does
+// not exist or the new path already exists.
+func (h fsHandler) Rename(oldpath, newpath string) error {
+	if wfs, ok := h.fsys.(WritableFS); ok {
+		return wfs.Rename(fsName(oldpath), fsName(newpath))
+	}
+	return ErrPermDenied
+}
+
+// Stat retrieves info about the given path, following symlinks.
+func (h fsHandler) Stat(name string) (os.FileInfo, error) {
+	return fs.Stat(h.fsys, fsName(name))
+}
+
+// Lstat retrieves info about the given path, and does not follow symlinks,
+// i.e. it can return information about symlinks themselves.
+func (h fsHandler) Lstat(name string) (os.FileInfo, error) {
+	if lfs, ok := h.fsys.(readLinkFS); ok {
+		return lfs.Lstat(fsName(name))
+	}
+	return h.Stat(name)
+}
+
+// Setstat set attributes for the given path.
+func (h fsHandler) Setstat(name string, attr *FileAttr) error {
+	return ErrPermDenied
+}
+
+// Capabilities reports symlink support only if the fs.FS can read links.
+func (h fsHandler) Capabilities() Capabilities {
+	_, ok := h.fsys.(readLinkFS)
+	return Capabilities{Symlinks: ok}
+}
+
+// Symlink creates a symlink with the given target.
+func (h fsHandler) Symlink(name, target string) error {
+	return ErrPermDenied
+}
+
+// ReadLink returns the target path of the given symbolic link.
+func (h fsHandler) ReadLink(name string) (string, error) {
+	if lfs, ok := h.fsys.(readLinkFS); ok {
+		return lfs.ReadLink(fsName(name))
+	}
+	return "", ErrOpUnsupported
+}
+
+// Rmdir removes the specified directory. An error should be returned if the
+// given path does not exists, is not a directory, or has children.
+func (h fsHandler) Rmdir(name string) error {
+	return h.remove(name, true)
+}
+
+// Remove removes the specified file. An error should be returned if the path
+// does not exist or it is a directory.
+func (h fsHandler) Remove(name string) error {
+	return h.remove(name, false)
+}
+
+// remove removes the given path, provided that whether it is a directory
+// matches isDir, since WritableFS.Remove accepts both.
+func (h fsHandler) remove(name string, isDir bool) error {
+	wfs, ok := h.fsys.(WritableFS)
+	if !ok {
+		return ErrPermDenied
+	}
+	fi, err := h.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if isDir && !fi.IsDir() {
+		return ErrNotADirectory
+	} else if !isDir && fi.IsDir() {
+		return ErrIsADirectory
+	}
+	return wfs.Remove(fsName(name))
+}
+
+// RealPath is responsible for producing an absolute path from a relative one.
+func (h fsHandler) RealPath(name string) (string, error) {
+	return path.Join("/", name), nil
+}
+
+// fsFile is a FileHandle for an fs.File, which is writable if it was opened
+// by WritableFS.OpenFileWrite.
+type fsFile struct {
+	fs.FileInfo
+	raw    fs.File
+	append bool       // opened with O_APPEND, which *os.File.WriteAt refuses
+	mtx    sync.Mutex // serializes seeking reads for files lacking io.ReaderAt
+}
+
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error) {
+	if ra, ok := f.raw.(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+	rs, ok := f.raw.(io.ReadSeeker)
+	if !ok {
+		return 0, ErrOpUnsupported.WithMessage("file does not support random access")
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, err := rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	// Behave like io.ReaderAt, which only reads short at the end of the file
+	n, err := io.ReadFull(rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *fsFile) WriteAt(p []byte, off int64) (int, error) {
+	w, ok := f.raw.(WritableFile)
+	if !ok {
+		return 0, ErrPermDenied
+	}
+	if f.append {
+		return w.Write(p)
+	}
+	return w.WriteAt(p, off)
+}
+
+// Stat re-stats the file, since the embedded os.FileInfo is only a snapshot
+// taken when the file was opened.
+func (f *fsFile) Stat() (os.FileInfo, error) {
+	return f.raw.Stat()
+}
+
+func (f *fsFile) Close() error {
+	return f.raw.Close()
+}
+
+func (f *fsFile) Setstat(attr *FileAttr) error {
+	return ErrPermDenied
+}
+
+type fsDir struct {
+	fs.ReadDirFile
+}
+
+func (d fsDir) ReadEntries(dst []os.FileInfo) (copied int, err error) {
+	var entries []fs.DirEntry
+	for copied < len(dst) && err == nil {
+		if entries, err = d.ReadDir(len(dst) - copied); err != nil && len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			info, ierr := entry.Info()
+			if ierr != nil {
+				// The entry was removed since the directory was read
+				continue
+			}
+			dst[copied] = info
+			copied++
+		}
+	}
+	return
+}
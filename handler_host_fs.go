@@ -3,7 +3,13 @@ package sftp
 // sftp server counterpart
 
 import (
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
 )
 
 // HostFSOpts is used to configure a HostFS RequestHandler.
@@ -11,6 +17,48 @@ import (
 // TODO(samterainsights): Add HomeDirectory for resolving relative paths.
 type HostFSOpts struct {
 	AllowWrite bool // Permit requests which modify the filesystem?
+
+	// RefuseSpecialFiles causes OpenFile to fail with ErrOpUnsupported for
+	// anything other than regular files, e.g. FIFOs, sockets and devices.
+	// Opening a FIFO blocks until a writer appears, so a client could
+	// otherwise tie up the server indefinitely.
+	RefuseSpecialFiles bool
+
+	// NoFollowSymlinks causes OpenFile to fail with ErrLinkLoop if the path
+	// itself is a symbolic link, using O_NOFOLLOW where the OS supports it.
+	// Symbolic links among the parent directories are still followed.
+	NoFollowSymlinks bool
+
+	// AllowOverwriteOnRename permits SSH_FXP_RENAME to replace an existing
+	// file, as rename(2) does. By default Rename fails with
+	// ErrFileAlreadyExists if the new path exists, as the SFTP spec requires.
+	// Clients wanting to overwrite atomically can use PosixRename regardless.
+	AllowOverwriteOnRename bool
+
+	// CrossDeviceRename makes renames between filesystems, which the OS
+	// refuses with EXDEV, copy the file and then remove the original. Its
+	// permissions, times and, where permitted, ownership are preserved.
+	// Directories cannot be moved this way. By default such renames fail with
+	// ErrOpUnsupported.
+	CrossDeviceRename bool
+
+	// ResolveReadlinkAbsolute makes ReadLink resolve relative link targets
+	// against the link's directory, so that clients always receive a clean,
+	// absolute path. By default the target is returned exactly as stored.
+	ResolveReadlinkAbsolute bool
+
+	// SetstatViaFD makes Setstat open the path without following a final
+	// symbolic link and then change its attributes through the descriptor.
+	// Otherwise a symlink swapped in between the lookups of successive
+	// path-based syscalls could redirect some of them elsewhere. This relies
+	// on O_NOFOLLOW, so has no effect on OSs without it, and file flags are
+	// still set by path.
+	SetstatViaFD bool
+
+	// ReportACLs makes stat replies carry the POSIX ACL of files which have
+	// one in the ACLExtension. It is only supported on Linux, and costs extra
+	// syscalls for every stat, so is off by default.
+	ReportACLs bool
 }
 
 // HostFS creates a RequestHandler wrapping the OS filesystem.
@@ -27,9 +75,29 @@ func (fs hostFS) OpenFile(name string, flag int, perm os.FileMode) (FileHandle,
 	if !fs.AllowWrite && flag&(os.O_CREATE|os.O_RDWR|os.O_WRONLY) != 0 {
 		return nil, ErrPermDenied
 	}
+	if fs.RefuseSpecialFiles {
+		// Checking the path before opening it would be racy, so open it
+		// without blocking, in case it is a FIFO, and check what was opened
+		flag |= oNonBlock
+	}
+	if fs.NoFollowSymlinks {
+		if oNoFollow == 0 && isSymlink(name) {
+			// No O_NOFOLLOW on this OS, so settle for a racy check
+			return nil, ErrLinkLoop
+		}
+		flag |= oNoFollow
+	}
 	f, err := os.OpenFile(name, flag, perm)
 	if err != nil {
-		return nil, err
+		if fs.NoFollowSymlinks && isSymlink(name) {
+			// Not every OS reports O_NOFOLLOW failures as ELOOP
+			return nil, ErrLinkLoop
+		}
+		if fs.RefuseSpecialFiles && errors.Is(err, syscall.ENXIO) {
+			// e.g. a FIFO opened for writing without a reader
+			return nil, ErrOpUnsupported.WithMessage("not a regular file")
+		}
+		return nil, checkParent(name, err)
 	}
 	fi, err := f.Stat()
 	if err != nil {
@@ -38,9 +106,19 @@ func (fs hostFS) OpenFile(name string, flag int, perm os.FileMode) (FileHandle,
 	}
 	if fi.IsDir() {
 		f.Close()
-		return nil, ErrBadMessage
+		return nil, ErrIsADirectory
+	}
+	if fs.RefuseSpecialFiles {
+		if !fi.Mode().IsRegular() {
+			f.Close()
+			return nil, ErrOpUnsupported.WithMessage("not a regular file")
+		}
+		if err = clearNonBlock(f); err != nil {
+			f.Close()
+			return nil, err
+		}
 	}
-	return hostFile{fi, f}, nil
+	return hostFile{fi, f, fs.AllowWrite, flag&os.O_APPEND != 0, fs.ReportACLs}, nil
 }
 
 // Mkdir creates a new directory. An error should be returned if the specified
@@ -49,7 +127,21 @@ func (fs hostFS) Mkdir(name string, attr *FileAttr) error {
 	if !fs.AllowWrite {
 		return ErrPermDenied
 	}
-	return os.Mkdir(name, attr.Perms)
+	if err := os.Mkdir(name, attr.Perms); err != nil {
+		return checkParent(name, err)
+	}
+	// os.Mkdir is subject to the process umask and cannot set ownership or
+	// times, so explicitly apply whatever attributes the client specified.
+	// If any fails, e.g. chown without privileges, remove the directory again
+	// so the client is not left with a half-configured one it was told could
+	// not be created.
+	dirAttr := *attr
+	dirAttr.Flags &^= AttrFlagSize
+	if err := fs.Setstat(name, &dirAttr); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
 }
 
 // OpenDir opens a directory for scanning. An error should be returned if the
@@ -79,18 +171,139 @@ func (fs hostFS) Rename(oldpath, newpath string) error {
 	if !fs.AllowWrite {
 		return ErrPermDenied
 	}
-	return os.Rename(oldpath, newpath)
+	if !fs.AllowOverwriteOnRename {
+		// Racy, but the OS offers no portable way to rename without replacing
+		if _, err := os.Lstat(newpath); err == nil {
+			return ErrFileAlreadyExists
+		}
+	}
+	if err := os.Rename(oldpath, newpath); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			return fs.renameAcrossDevices(oldpath, newpath)
+		}
+		if _, serr := os.Lstat(oldpath); serr == nil {
+			// The source exists, so the destination must be at fault
+			return checkParent(newpath, err)
+		}
+		return err
+	}
+	return nil
 }
 
-// Stat retrieves info about the given path, following symlinks.
+// Capabilities reports full support for all optional operations.
+func (fs hostFS) Capabilities() Capabilities {
+	return Capabilities{Symlinks: true, PosixRename: true, StatVFS: true}
+}
+
+// PosixRename renames the given path, atomically replacing the new path if it
+// already exists.
+func (fs hostFS) PosixRename(oldpath, newpath string) error {
+	if !fs.AllowWrite {
+		return ErrPermDenied
+	}
+	err := os.Rename(oldpath, newpath)
+	if errors.Is(err, syscall.EXDEV) {
+		return fs.renameAcrossDevices(oldpath, newpath)
+	}
+	return err
+}
+
+// renameAcrossDevices emulates renaming between filesystems, if enabled, by
+// copying to a temporary file beside newpath, renaming it into place and then
+// removing oldpath. Any existing file at newpath is replaced, so Rename must
+// check for one beforehand.
+func (fs hostFS) renameAcrossDevices(oldpath, newpath string) error {
+	if !fs.CrossDeviceRename {
+		return ErrOpUnsupported.WithMessage("cannot rename across filesystems")
+	}
+	info, err := os.Lstat(oldpath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return ErrOpUnsupported.WithMessage("only regular files can be moved across filesystems")
+	}
+	tmp, err := copyFileBeside(oldpath, newpath, info)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, newpath); err == nil {
+		if err = os.Remove(oldpath); err == nil {
+			return nil
+		}
+		tmp = newpath // don't leave two copies behind
+	}
+	os.Remove(tmp)
+	return err
+}
+
+// copyFileBeside copies the regular file at src, described by info, to a new
+// temporary file in the same directory as dst, returning the temporary path.
+func copyFileBeside(src, dst string, info os.FileInfo) (tmpName string, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return "", checkParent(dst, err)
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(out.Name())
+		}
+	}()
+
+	if _, err = io.Copy(out, in); err != nil {
+		return "", err
+	}
+	attr := exactFileAttrFromInfo(info)
+	if attr.Flags&AttrFlagUIDGID != 0 {
+		out.Chown(int(attr.UID), int(attr.GID)) // best effort, as only root may give files away
+	}
+	if err = out.Chmod(attr.Perms & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err != nil {
+		return "", err
+	}
+	if err = out.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Chtimes(out.Name(), attr.AcTime, attr.ModTime); err != nil {
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// StatVFS retrieves info about the filesystem containing the given path.
+func (fs hostFS) StatVFS(name string) (*StatVFS, error) {
+	return statVFS(name)
+}
+
+// Stat retrieves info about the given path, following symlinks. Statting a
+// dangling symlink fails with ErrNoSuchFile, even though Lstat succeeds.
 func (fs hostFS) Stat(name string) (os.FileInfo, error) {
-	return os.Stat(name)
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		if linfo, lerr := os.Lstat(name); lerr == nil && linfo.Mode()&os.ModeSymlink != 0 {
+			return nil, ErrNoSuchFile.WithMessage("symbolic link target does not exist")
+		}
+	}
+	if err == nil && fs.ReportACLs {
+		info = withACL(info, pathACL(name, true))
+	}
+	return info, err
 }
 
 // Lstat retrieves info about the given path, and does not follow symlinks,
 // i.e. it can return information about symlinks themselves.
 func (fs hostFS) Lstat(name string) (os.FileInfo, error) {
-	return os.Lstat(name)
+	info, err := os.Lstat(name)
+	if err == nil && fs.ReportACLs {
+		info = withACL(info, pathACL(name, false))
+	}
+	return info, err
 }
 
 // Setstat set attributes for the given path.
@@ -98,6 +311,9 @@ func (fs hostFS) Setstat(name string, attr *FileAttr) (err error) {
 	if !fs.AllowWrite {
 		return ErrPermDenied
 	}
+	if fs.SetstatViaFD && oNoFollow != 0 {
+		return fs.setstatViaFD(name, attr)
+	}
 	if attr.Flags&AttrFlagSize != 0 {
 		if err = os.Truncate(name, int64(attr.Size)); err != nil {
 			return
@@ -114,9 +330,28 @@ func (fs hostFS) Setstat(name string, attr *FileAttr) (err error) {
 		}
 	}
 	if attr.Flags&AttrFlagUIDGID != 0 {
-		err = os.Chown(name, int(attr.UID), int(attr.GID))
+		if err = os.Chown(name, int(attr.UID), int(attr.GID)); err != nil {
+			return
+		}
 	}
-	return
+	return applyFileFlags(name, attr)
+}
+
+// setstatViaFD implements Setstat for HostFSOpts.SetstatViaFD.
+func (fs hostFS) setstatViaFD(name string, attr *FileAttr) error {
+	flag := os.O_RDONLY
+	if attr.Flags&AttrFlagSize != 0 {
+		flag = os.O_WRONLY // needed to truncate
+	}
+	f, err := os.OpenFile(name, flag|oNoFollow|oNonBlock, 0)
+	if err != nil {
+		if isSymlink(name) {
+			return ErrLinkLoop.WithMessage("refusing to follow a symbolic link")
+		}
+		return err
+	}
+	defer f.Close()
+	return hostFile{raw: f, allowWrite: true}.Setstat(attr)
 }
 
 // Symlink creates a symlink with the given target.
@@ -124,12 +359,19 @@ func (fs hostFS) Symlink(name, target string) error {
 	if !fs.AllowWrite {
 		return ErrPermDenied
 	}
-	return os.Symlink(target, name)
+	return checkParent(name, os.Symlink(target, name))
 }
 
 // ReadLink returns the target path of the given symbolic link.
 func (fs hostFS) ReadLink(name string) (string, error) {
-	return os.Readlink(name)
+	target, err := os.Readlink(name)
+	if err != nil || !fs.ResolveReadlinkAbsolute {
+		return target, err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(name), target)
+	}
+	return filepath.Clean(target), nil
 }
 
 // Rmdir removes the specified directory. An error should be returned if the
@@ -169,9 +411,30 @@ func (fs hostFS) RealPath(name string) (string, error) {
 	return "", ErrOpUnsupported // TODO(samterainsights)
 }
 
+// isSymlink reports whether the given path is a symbolic link.
+func isSymlink(name string) bool {
+	fi, err := os.Lstat(name)
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
+
+// checkParent refines a "not exist" error for the given path into ErrNoSuchPath
+// if it was caused by a missing parent directory rather than the final path
+// component. Other errors are returned as-is.
+func checkParent(name string, err error) error {
+	if os.IsNotExist(err) {
+		if _, perr := os.Stat(filepath.Dir(name)); os.IsNotExist(perr) {
+			return ErrNoSuchPath
+		}
+	}
+	return err
+}
+
 type hostFile struct {
 	os.FileInfo
-	raw *os.File
+	raw        *os.File
+	allowWrite bool
+	append     bool // opened with O_APPEND, which *os.File.WriteAt refuses
+	reportACLs bool
 }
 
 func (f hostFile) ReadAt(dst []byte, offset int64) (int, error) {
@@ -179,14 +442,39 @@ func (f hostFile) ReadAt(dst []byte, offset int64) (int, error) {
 }
 
 func (f hostFile) WriteAt(data []byte, offset int64) (int, error) {
+	if f.append {
+		// The OS appends regardless of offset, as PFlagAppend requires
+		return f.raw.Write(data)
+	}
 	return f.raw.WriteAt(data, offset)
 }
 
+// Stat re-stats the file, since the embedded os.FileInfo is only a snapshot
+// taken when the file was opened.
+func (f hostFile) Stat() (os.FileInfo, error) {
+	fi, err := f.raw.Stat()
+	if err == nil && f.reportACLs {
+		fi = withACL(fi, fileACL(f.raw))
+	}
+	return fi, err
+}
+
+// Preallocate reserves disk space for the file where the OS supports it.
+func (f hostFile) Preallocate(size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	return preallocateFile(f.raw, size)
+}
+
 func (f hostFile) Close() error {
 	return f.raw.Close()
 }
 
 func (f hostFile) Setstat(attr *FileAttr) (err error) {
+	if !f.allowWrite {
+		return ErrPermDenied
+	}
 	if attr.Flags&AttrFlagSize != 0 {
 		if err = f.raw.Truncate(int64(attr.Size)); err != nil {
 			return
@@ -198,7 +486,7 @@ func (f hostFile) Setstat(attr *FileAttr) (err error) {
 		}
 	}
 	if attr.Flags&AttrFlagAcModTime != 0 {
-		if err = os.Chtimes(f.raw.Name(), attr.AcTime, attr.ModTime); err != nil {
+		if err = fileChtimes(f.raw, attr.AcTime, attr.ModTime); err != nil {
 			return
 		}
 	}
@@ -207,7 +495,7 @@ func (f hostFile) Setstat(attr *FileAttr) (err error) {
 			return
 		}
 	}
-	return
+	return applyFileFlags(f.raw.Name(), attr)
 }
 
 type hostDir struct {
@@ -216,9 +504,33 @@ type hostDir struct {
 
 func (d hostDir) ReadEntries(dst []os.FileInfo) (copied int, err error) {
 	var entries []os.FileInfo
-	for copied < len(dst) && err == nil {
+	for retries := 0; copied < len(dst) && err == nil; {
 		entries, err = d.Readdir(len(dst) - copied)
-		copy(dst[copied:], entries)
+		copied += copy(dst[copied:], entries)
+		if isEINTR(err) && retries < maxEINTRRetries {
+			retries++
+			err = nil
+		}
+	}
+	return
+}
+
+// maxEINTRRetries is the number of times HostFS retries a syscall which was
+// interrupted by a signal before giving up and reporting the error.
+const maxEINTRRetries = 5
+
+func isEINTR(err error) bool {
+	return errors.Is(err, syscall.EINTR)
+}
+
+// retryEINTR calls fn until it returns an error other than EINTR or it has
+// been retried maxEINTRRetries times. Most of the os package already does this
+// internally, but raw syscalls such as statfs(2) do not.
+func retryEINTR(fn func() error) (err error) {
+	for i := 0; i <= maxEINTRRetries; i++ {
+		if err = fn(); !isEINTR(err) {
+			return
+		}
 	}
 	return
 }
@@ -0,0 +1,73 @@
+// +build !windows,!plan9,!js
+
+package sftp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestRefuseSpecialFiles checks that opening a FIFO, directly or through a
+// symbolic link, is refused promptly rather than blocking until the other end
+// is opened, and that regular files are still opened in blocking mode.
+func TestRefuseSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	fifo := filepath.Join(dir, "fifo")
+	if err := unix.Mkfifo(fifo, 0644); err != nil {
+		t.Skipf("cannot create a FIFO: %v", err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(fifo, link); err != nil {
+		t.Fatal(err)
+	}
+	regular := filepath.Join(dir, "regular")
+	if err := os.WriteFile(regular, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := HostFS(HostFSOpts{AllowWrite: true, RefuseSpecialFiles: true})
+	for _, tc := range []struct {
+		name string
+		flag int
+	}{
+		{fifo, os.O_RDONLY},
+		{fifo, os.O_WRONLY},
+		{fifo, os.O_RDWR},
+		{link, os.O_RDONLY},
+	} {
+		done := make(chan error, 1)
+		go func() {
+			f, err := fs.OpenFile(tc.name, tc.flag, 0)
+			if err == nil {
+				f.Close()
+			}
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrOpUnsupported) {
+				t.Errorf("OpenFile(%s, %#x) = %v, want ErrOpUnsupported", filepath.Base(tc.name), tc.flag, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("OpenFile(%s, %#x) blocked", filepath.Base(tc.name), tc.flag)
+		}
+	}
+
+	f, err := fs.OpenFile(regular, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile of a regular file: %v", err)
+	}
+	defer f.Close()
+	flags, err := unix.FcntlInt(f.(hostFile).raw.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&unix.O_NONBLOCK != 0 {
+		t.Fatal("regular file left in non-blocking mode")
+	}
+}
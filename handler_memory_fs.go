@@ -6,17 +6,28 @@ package sftp
 
 import (
 	"errors"
+	"io"
 	"os"
 	"path"
-	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+// maxMemFileSize is the largest size to which a client may grow a MemFS file,
+// since its content is allocated in full.
+const maxMemFileSize = 1 << 30
+
+// maxMemLinks is the number of symbolic links MemFS follows when resolving a
+// path before failing with ErrLinkLoop.
+const maxMemLinks = 40
+
 // In memory file-system-y thing that the Hanlders live on
 type memFS struct {
 	files    map[string]*memFile
 	filesMtx sync.RWMutex
+	lastIno  uint64 // the ID of the most recently created file; guarded by filesMtx
 }
 
 // MemFS creates a new in-memory filesystem capable of servicing SFTP requests.
@@ -24,26 +35,62 @@ func MemFS() RequestHandler {
 	return &memFS{
 		files: map[string]*memFile{
 			"/": &memFile{
+				ino:     1,
 				modtime: time.Now(),
+				perms:   0755,
 				isdir:   true,
 			},
 		},
+		lastIno: 1,
 	}
 }
 
 // OpenFile should behave identically to os.OpenFile.
 func (fs *memFS) OpenFile(name string, flag int, perm os.FileMode) (FileHandle, error) {
-	fs.filesMtx.RLock()
-	defer fs.filesMtx.RUnlock()
+	fs.filesMtx.Lock()
+	defer fs.filesMtx.Unlock()
 
-	if f, ok := fs.files[name]; ok {
+	if flag&(os.O_CREATE|os.O_EXCL) != os.O_CREATE|os.O_EXCL {
+		// As with open(2), O_EXCL fails on a symbolic link rather than
+		// creating its target
+		var err error
+		if name, err = fs.resolve(name); err != nil {
+			return nil, err
+		}
+	}
+	f, exists := fs.files[name]
+	if exists {
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, ErrFileAlreadyExists
+		}
 		if f.isdir {
 			return nil, ErrIsADirectory
 		}
-		return f, nil
+		if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			if err := f.setAttr(&FileAttr{Flags: AttrFlagSize}); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if flag&os.O_CREATE == 0 {
+			return nil, ErrNoSuchFile
+		}
+		if parent, exists := fs.files[path.Dir(name)]; !exists {
+			return nil, ErrNoSuchPath
+		} else if !parent.isdir {
+			return nil, ErrNotADirectory
+		}
+		fs.lastIno++
+		f = &memFile{
+			ino:     fs.lastIno,
+			name:    path.Base(name),
+			modtime: time.Now(),
+			perms:   perm & os.ModePerm,
+		}
+		fs.files[name] = f
 	}
 
-	return nil, ErrNoSuchFile
+	return &memHandle{f, flag}, nil
 }
 
 // Mkdir creates a new directory. An error should be returned if the specified
@@ -53,16 +100,28 @@ func (fs *memFS) Mkdir(name string, attr *FileAttr) error {
 	defer fs.filesMtx.Unlock()
 
 	if _, exists := fs.files[name]; exists {
-		return errors.New("path exists")
+		return ErrFileAlreadyExists
+	}
+	if parent, exists := fs.files[path.Dir(name)]; !exists {
+		return ErrNoSuchPath
+	} else if !parent.isdir {
+		return ErrNotADirectory
 	}
 
-	fs.files[name] = &memFile{
+	fs.lastIno++
+	f := &memFile{
+		ino:     fs.lastIno,
 		name:    path.Base(name),
-		modtime: attr.ModTime,
+		modtime: time.Now(),
+		perms:   0755,
 		isdir:   true,
 	}
+	if err := f.setAttr(attr); err != nil {
+		return err
+	}
+	fs.files[name] = f
 
-	return nil // TODO(samterainsights)
+	return nil
 }
 
 // OpenDir opens a directory for scanning. An error should be returned if the
@@ -70,7 +129,31 @@ func (fs *memFS) Mkdir(name string, attr *FileAttr) error {
 // io.Closer, its Close method will be called once the SFTP client is done
 // scanning.
 func (fs *memFS) OpenDir(name string) (DirReader, error) {
-	return nil, nil // TODO(samterainsights)
+	fs.filesMtx.RLock()
+	defer fs.filesMtx.RUnlock()
+
+	name, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if f, exists := fs.files[name]; !exists {
+		return nil, ErrNoSuchFile
+	} else if !f.isdir {
+		return nil, ErrNotADirectory
+	}
+
+	var entries []os.FileInfo
+	for p, f := range fs.files {
+		if p != name && path.Dir(p) == name {
+			// Name entries by their current path, which may differ from
+			// the name they were created with if they have been renamed
+			entries = append(entries, namedFileInfo{f, path.Base(p)})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return &sliceDirReader{entries}, nil
 }
 
 // Rename renames the given path. An error should be returned if the path does
@@ -79,17 +162,51 @@ func (fs *memFS) Rename(oldpath, newpath string) error {
 	fs.filesMtx.Lock()
 	defer fs.filesMtx.Unlock()
 
-	if f, exists := fs.files[oldpath]; exists {
-		fs.files[newpath] = f
-		return nil
+	f, exists := fs.files[oldpath]
+	if !exists {
+		return ErrNoSuchFile
+	}
+	if _, exists := fs.files[newpath]; exists {
+		return ErrFileAlreadyExists
+	}
+	if oldpath == "/" || strings.HasPrefix(newpath, oldpath+"/") {
+		return ErrBadMessage.WithMessage("cannot move a directory into itself")
+	}
+	if parent, exists := fs.files[path.Dir(newpath)]; !exists {
+		return ErrNoSuchPath
+	} else if !parent.isdir {
+		return ErrNotADirectory
 	}
 
-	return ErrNoSuchFile
+	fs.files[newpath] = f
+	delete(fs.files, oldpath)
+	if f.isdir {
+		// Move the directory's descendants along with it
+		prefix := oldpath + "/"
+		for p, child := range fs.files {
+			if strings.HasPrefix(p, prefix) {
+				fs.files[path.Join(newpath, p[len(prefix):])] = child
+				delete(fs.files, p)
+			}
+		}
+	}
+	return nil
 }
 
 // Stat retrieves info about the given path, following symlinks.
 func (fs *memFS) Stat(name string) (os.FileInfo, error) {
-	return fs.Lstat(name) // we don't support symlinks so same operation as lstat
+	fs.filesMtx.RLock()
+	defer fs.filesMtx.RUnlock()
+
+	name, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if f, exists := fs.files[name]; exists {
+		return f, nil
+	}
+
+	return nil, ErrNoSuchFile
 }
 
 // Lstat retrieves info about the given path, and does not follow symlinks,
@@ -110,6 +227,10 @@ func (fs *memFS) Setstat(name string, attr *FileAttr) error {
 	fs.filesMtx.RLock()
 	defer fs.filesMtx.RUnlock()
 
+	name, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
 	if f, exists := fs.files[name]; exists {
 		return f.Setstat(attr)
 	}
@@ -117,14 +238,72 @@ func (fs *memFS) Setstat(name string, attr *FileAttr) error {
 	return ErrNoSuchFile
 }
 
+// Capabilities reports that the in-memory filesystem supports symlinks, but
+// no extensions.
+func (fs *memFS) Capabilities() Capabilities {
+	return Capabilities{Symlinks: true}
+}
+
 // Symlink creates a symlink with the given target.
 func (fs *memFS) Symlink(name, target string) error {
-	return ErrOpUnsupported
+	if target == "" {
+		return ErrBadMessage.WithMessage("empty symbolic link target")
+	}
+
+	fs.filesMtx.Lock()
+	defer fs.filesMtx.Unlock()
+
+	if _, exists := fs.files[name]; exists {
+		return ErrFileAlreadyExists
+	}
+	if parent, exists := fs.files[path.Dir(name)]; !exists {
+		return ErrNoSuchPath
+	} else if !parent.isdir {
+		return ErrNotADirectory
+	}
+
+	fs.lastIno++
+	fs.files[name] = &memFile{
+		ino:     fs.lastIno,
+		name:    path.Base(name),
+		modtime: time.Now(),
+		symlink: target,
+	}
+	return nil
 }
 
 // ReadLink returns the target path of the given symbolic link.
 func (fs *memFS) ReadLink(name string) (string, error) {
-	return "", ErrOpUnsupported
+	fs.filesMtx.RLock()
+	defer fs.filesMtx.RUnlock()
+
+	f, exists := fs.files[name]
+	if !exists {
+		return "", ErrNoSuchFile
+	}
+	if f.symlink == "" {
+		return "", ErrBadMessage.WithMessage("not a symbolic link")
+	}
+	return f.symlink, nil
+}
+
+// resolve follows the symbolic link at the given path, and any it leads to,
+// returning the path of the first file which is not a link or does not exist.
+// Only the last component of the path is followed. It must be called with
+// fs.filesMtx held.
+func (fs *memFS) resolve(name string) (string, error) {
+	for i := 0; i < maxMemLinks; i++ {
+		f, exists := fs.files[name]
+		if !exists || f.symlink == "" {
+			return name, nil
+		}
+		if target := f.symlink; path.IsAbs(target) {
+			name = path.Clean(target)
+		} else {
+			name = path.Join(path.Dir(name), target)
+		}
+	}
+	return "", ErrLinkLoop
 }
 
 // Rmdir removes the specified directory. An error should be returned if the
@@ -137,7 +316,13 @@ func (fs *memFS) Rmdir(name string) error {
 		if !f.isdir {
 			return ErrNotADirectory
 		}
+		for p := range fs.files {
+			if p != name && path.Dir(p) == name {
+				return ErrDirNotEmpty
+			}
+		}
 		delete(fs.files, name)
+		return nil
 	}
 
 	return ErrNoSuchFile
@@ -154,6 +339,7 @@ func (fs *memFS) Remove(name string) error {
 			return ErrIsADirectory
 		}
 		delete(fs.files, name)
+		return nil
 	}
 
 	return ErrNoSuchFile
@@ -167,9 +353,12 @@ func (fs *memFS) RealPath(name string) (string, error) {
 // Implements os.FileInfo, Reader and Writer interfaces.
 // These are the 3 interfaces necessary for the Handlers.
 type memFile struct {
+	ino         uint64 // unique to the file within its memFS
 	name        string
 	modtime     time.Time
-	modtimeMtx  sync.Mutex
+	perms       os.FileMode
+	uid, gid    uint32
+	attrMtx     sync.Mutex // guards modtime, perms, uid and gid
 	symlink     string
 	isdir       bool
 	content     []byte
@@ -177,56 +366,160 @@ type memFile struct {
 }
 
 // Have memFile fulfill os.FileInfo interface
-func (f *memFile) Name() string { return filepath.Base(f.name) }
-func (f *memFile) Size() int64  { return int64(len(f.content)) }
+func (f *memFile) Name() string { return path.Base(f.name) }
+func (f *memFile) Size() int64 {
+	f.contentLock.RLock()
+	defer f.contentLock.RUnlock()
+	return int64(len(f.content))
+}
 func (f *memFile) Mode() os.FileMode {
-	ret := os.FileMode(0644)
-	if f.isdir {
-		ret = os.FileMode(0755) | os.ModeDir
-	}
-	if f.symlink != "" {
-		ret = os.FileMode(0777) | os.ModeSymlink
-	}
-	return ret
+	f.attrMtx.Lock()
+	defer f.attrMtx.Unlock()
+	return f.mode()
 }
 func (f *memFile) ModTime() time.Time {
-	f.modtimeMtx.Lock()
-	defer f.modtimeMtx.Unlock()
+	f.attrMtx.Lock()
+	defer f.attrMtx.Unlock()
 	return f.modtime
 }
-func (f *memFile) IsDir() bool { return f.isdir }
+func (f *memFile) IsDir() bool           { return f.isdir }
+func (f *memFile) inode() (uint64, bool) { return f.ino, true }
 func (f *memFile) Sys() interface{} {
-	return nil
+	f.attrMtx.Lock()
+	defer f.attrMtx.Unlock()
+	return f.attr()
+}
+
+// attr must be called with f.attrMtx held.
+func (f *memFile) attr() *FileAttr {
+	return &FileAttr{
+		Flags:   AttrFlagSize | AttrFlagUIDGID | AttrFlagPermissions | AttrFlagAcModTime,
+		Size:    uint64(f.Size()),
+		UID:     f.uid,
+		GID:     f.gid,
+		Perms:   f.mode(),
+		AcTime:  f.modtime,
+		ModTime: f.modtime,
+	}
+}
+
+// mode must be called with f.attrMtx held.
+func (f *memFile) mode() os.FileMode {
+	if f.symlink != "" {
+		return os.FileMode(0777) | os.ModeSymlink
+	}
+	if f.isdir {
+		return f.perms&os.ModePerm | os.ModeDir
+	}
+	return f.perms & os.ModePerm
 }
 
 func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
 	f.contentLock.RLock()
 	defer f.contentLock.RUnlock()
-	return copy(p, f.content[off:]), nil
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(f.content)) {
+		return 0, io.EOF
+	}
+	// As with *os.File, a read reaching the end of the content returns io.EOF
+	n := copy(p, f.content[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
 func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
 	f.contentLock.Lock()
 	defer f.contentLock.Unlock()
 
-	minLen := len(p) + int(off)
-	if minLen >= len(f.content) {
-		nc := make([]byte, minLen)
-		copy(nc, f.content)
-		f.content = nc
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off > maxMemFileSize-int64(len(p)) {
+		return 0, ErrGeneric.WithMessagef("file size is limited to %d bytes", maxMemFileSize)
+	}
+	if minLen := int(off) + len(p); minLen > len(f.content) {
+		// Grow by appending zeros, which also fills any gap before off, so
+		// that capacity grows geometrically and sequential writes of many
+		// small chunks take amortized linear time
+		f.content = append(f.content, make([]byte, minLen-len(f.content))...)
 	}
 	copy(f.content[off:], p)
 
 	return len(p), nil
 }
 
+// memHandle is a memFile opened with the given flags, which restrict how it may
+// be accessed.
+type memHandle struct {
+	*memFile
+	flag int
+}
+
+func (h *memHandle) ReadAt(p []byte, off int64) (int, error) {
+	if h.flag&os.O_WRONLY != 0 {
+		return 0, ErrPermDenied
+	}
+	return h.memFile.ReadAt(p, off)
+}
+
+func (h *memHandle) WriteAt(p []byte, off int64) (int, error) {
+	if h.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, ErrPermDenied
+	}
+	if h.flag&os.O_APPEND != 0 {
+		return h.memFile.appendData(p)
+	}
+	return h.memFile.WriteAt(p, off)
+}
+
+// appendData writes to the end of the file, wherever that is at the time.
+func (f *memFile) appendData(p []byte) (int, error) {
+	f.contentLock.Lock()
+	defer f.contentLock.Unlock()
+	if int64(len(f.content)) > maxMemFileSize-int64(len(p)) {
+		return 0, ErrGeneric.WithMessagef("file size is limited to %d bytes", maxMemFileSize)
+	}
+	f.content = append(f.content, p...)
+	return len(p), nil
+}
+
 func (f *memFile) Close() error {
 	return nil
 }
 
 func (f *memFile) Setstat(attr *FileAttr) error {
-	f.modtimeMtx.Lock()
-	f.modtime = attr.ModTime
-	f.modtimeMtx.Unlock()
+	return f.setAttr(attr)
+}
+
+// setAttr applies the flagged attributes to the file, leaving the rest as-is.
+// It applies none of them if the size is too large.
+func (f *memFile) setAttr(attr *FileAttr) error {
+	resize := attr.Flags&AttrFlagSize != 0 && !f.isdir
+	if resize && attr.Size > maxMemFileSize {
+		return ErrGeneric.WithMessagef("file size is limited to %d bytes", maxMemFileSize)
+	}
+
+	f.attrMtx.Lock()
+	defer f.attrMtx.Unlock()
+
+	merged := ApplyAttr(f.attr(), attr)
+	f.perms = merged.Perms & os.ModePerm
+	f.uid = merged.UID
+	f.gid = merged.GID
+	f.modtime = merged.ModTime
+
+	if resize {
+		f.contentLock.Lock()
+		if size := int(attr.Size); size <= len(f.content) {
+			f.content = f.content[:size]
+		} else {
+			f.content = append(f.content, make([]byte, size-len(f.content))...)
+		}
+		f.contentLock.Unlock()
+	}
 	return nil
 }
@@ -0,0 +1,39 @@
+package sftp
+
+import (
+	"os"
+	"testing"
+)
+
+// BenchmarkMemFSSequentialWrite uploads a 64 MiB file to MemFS in 32 KiB
+// chunks, as clients send them, both at explicit offsets and in append mode.
+// Either should take time linear in the size of the file.
+func BenchmarkMemFSSequentialWrite(b *testing.B) {
+	const size, chunkSize = 64 << 20, 32 << 10
+	for _, bc := range []struct {
+		name string
+		flag int
+	}{
+		{"WriteAt", os.O_WRONLY | os.O_CREATE | os.O_TRUNC},
+		{"Append", os.O_WRONLY | os.O_CREATE | os.O_TRUNC | os.O_APPEND},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			chunk := make([]byte, chunkSize)
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// A new file each time, so that its content grows from empty
+				f, err := MemFS().OpenFile("/file", bc.flag, 0644)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for off := int64(0); off < size; off += chunkSize {
+					if _, err := f.WriteAt(chunk, off); err != nil {
+						b.Fatal(err)
+					}
+				}
+				f.Close()
+			}
+		})
+	}
+}
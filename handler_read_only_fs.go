@@ -0,0 +1,182 @@
+package sftp
+
+// A trivial read-only RequestHandler serving a fixed set of files from memory,
+// useful for one-off downloads and tests.
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// ReadOnlyFS creates a RequestHandler serving a fixed, read-only snapshot of
+// the given files, keyed by path. Paths are interpreted relative to the root,
+// and any parent directories are created implicitly, so a path must not be
+// both a file and the parent of another file. All requests which would modify
+// the filesystem fail with ErrPermDenied.
+func ReadOnlyFS(files map[string][]byte) RequestHandler {
+	now := time.Now()
+	fs := &readOnlyFS{
+		files:    map[string]*roFile{"/": {name: "/", modtime: now, isdir: true}},
+		children: make(map[string][]os.FileInfo),
+	}
+
+	for name, content := range files {
+		name = path.Join("/", name)
+		fs.add(&roFile{name: path.Base(name), modtime: now, content: content}, name)
+
+		// Create any missing parent directories
+		for dir := path.Dir(name); fs.files[dir] == nil; dir = path.Dir(dir) {
+			fs.add(&roFile{name: path.Base(dir), modtime: now, isdir: true}, dir)
+		}
+	}
+
+	for _, entries := range fs.children {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name() < entries[j].Name()
+		})
+	}
+
+	return fs
+}
+
+type readOnlyFS struct {
+	files    map[string]*roFile
+	children map[string][]os.FileInfo
+}
+
+func (fs *readOnlyFS) add(f *roFile, name string) {
+	fs.files[name] = f
+	parent := path.Dir(name)
+	fs.children[parent] = append(fs.children[parent], f)
+}
+
+// OpenFile should behave identically to os.OpenFile.
+func (fs *readOnlyFS) OpenFile(name string, flag int, perm os.FileMode) (FileHandle, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, ErrPermDenied
+	}
+	f, exists := fs.files[name]
+	if !exists {
+		return nil, ErrNoSuchFile
+	}
+	if f.isdir {
+		return nil, ErrIsADirectory
+	}
+	return f, nil
+}
+
+// Mkdir creates a new directory. An error should be returned if the specified
+// path already exists.
+func (fs *readOnlyFS) Mkdir(name string, attr *FileAttr) error {
+	return ErrPermDenied
+}
+
+// OpenDir opens a directory for scanning. An error should be returned if the
+// given path is not a directory. If the returned DirReader can be cast to an
+// io.Closer, its Close method will be called once the SFTP client is done
+// scanning.
+func (fs *readOnlyFS) OpenDir(name string) (DirReader, error) {
+	f, exists := fs.files[name]
+	if !exists {
+		return nil, ErrNoSuchFile
+	}
+	if !f.isdir {
+		return nil, ErrNotADirectory
+	}
+	return &sliceDirReader{fs.children[name]}, nil
+}
+
+// Rename renames the given path. An error should be returned if the path does
+// not exist or the new path already exists.
+func (fs *readOnlyFS) Rename(oldpath, newpath string) error {
+	return ErrPermDenied
+}
+
+// Stat retrieves info about the given path, following symlinks.
+func (fs *readOnlyFS) Stat(name string) (os.FileInfo, error) {
+	return fs.Lstat(name) // there are no symlinks
+}
+
+// Lstat retrieves info about the given path, and does not follow symlinks,
+// i.e. it can return information about symlinks themselves.
+func (fs *readOnlyFS) Lstat(name string) (os.FileInfo, error) {
+	if f, exists := fs.files[name]; exists {
+		return f, nil
+	}
+	return nil, ErrNoSuchFile
+}
+
+// Setstat set attributes for the given path.
+func (fs *readOnlyFS) Setstat(name string, attr *FileAttr) error {
+	return ErrPermDenied
+}
+
+// Symlink creates a symlink with the given target.
+func (fs *readOnlyFS) Symlink(name, target string) error {
+	return ErrPermDenied
+}
+
+// ReadLink returns the target path of the given symbolic link.
+func (fs *readOnlyFS) ReadLink(name string) (string, error) {
+	if _, exists := fs.files[name]; !exists {
+		return "", ErrNoSuchFile
+	}
+	return "", ErrGeneric.WithMessage("not a symbolic link")
+}
+
+// Rmdir removes the specified directory. An error should be returned if the
+// given path does not exists, is not a directory, or has children.
+func (fs *readOnlyFS) Rmdir(name string) error {
+	return ErrPermDenied
+}
+
+// Remove removes the specified file. An error should be returned if the path
+// does not exist or it is a directory.
+func (fs *readOnlyFS) Remove(name string) error {
+	return ErrPermDenied
+}
+
+// RealPath is responsible for producing an absolute path from a relative one.
+func (fs *readOnlyFS) RealPath(name string) (string, error) {
+	return path.Join("/", name), nil
+}
+
+// roFile is an immutable file or directory, and is therefore safe to share
+// between any number of handles.
+type roFile struct {
+	name    string
+	modtime time.Time
+	isdir   bool
+	content []byte
+}
+
+func (f *roFile) Name() string       { return f.name }
+func (f *roFile) Size() int64        { return int64(len(f.content)) }
+func (f *roFile) ModTime() time.Time { return f.modtime }
+func (f *roFile) IsDir() bool        { return f.isdir }
+func (f *roFile) Sys() interface{}   { return nil }
+func (f *roFile) Mode() os.FileMode {
+	if f.isdir {
+		return os.FileMode(0555) | os.ModeDir
+	}
+	return os.FileMode(0444)
+}
+
+func (f *roFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f.content).ReadAt(p, off)
+}
+
+func (f *roFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrPermDenied
+}
+
+func (f *roFile) Close() error {
+	return nil
+}
+
+func (f *roFile) Setstat(attr *FileAttr) error {
+	return ErrPermDenied
+}
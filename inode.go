@@ -0,0 +1,60 @@
+package sftp
+
+import (
+	"os"
+	"strconv"
+)
+
+// InodeExtension is the name of the FileAttr extension which carries a stable
+// identifier of a file, such as its inode number, in decimal. It identifies the
+// file itself rather than its path, so it is unchanged by renames, but may be
+// reused once the file is removed. Only one filesystem is assumed, so files on
+// different mounts served by HostFS may share an identifier.
+//
+// The server reports it in stat replies if ServerOpts.ReportInodes is set, for
+// HostFS on Unix-like systems and for MemFS.
+const InodeExtension = "inode@tera-insights.com"
+
+// InodeFromAttr returns the identifier carried by InodeExtension in the given
+// attributes, if present and valid.
+func InodeFromAttr(attr *FileAttr) (ino uint64, ok bool) {
+	if attr.Flags&AttrFlagExtended == 0 {
+		return 0, false
+	}
+	for _, ext := range attr.Extensions {
+		if ext.Name == InodeExtension {
+			ino, err := strconv.ParseUint(ext.Data, 10, 64)
+			return ino, err == nil
+		}
+	}
+	return 0, false
+}
+
+// inodeReporter is implemented by os.FileInfos which identify their file
+// other than via Sys, including wrappers which forward the identifier of the
+// os.FileInfo they wrap.
+type inodeReporter interface {
+	inode() (uint64, bool)
+}
+
+// fileInode returns the identifier of the file described by fi, if known.
+func fileInode(fi os.FileInfo) (uint64, bool) {
+	if r, ok := fi.(inodeReporter); ok {
+		return r.inode()
+	}
+	return fileInodeOS(fi)
+}
+
+// withInode returns a copy of attr reporting the identifier of the file
+// described by fi, if known, or attr itself otherwise.
+func withInode(fi os.FileInfo, attr *FileAttr) *FileAttr {
+	ino, ok := fileInode(fi)
+	if !ok {
+		return attr
+	}
+	withIno := *attr
+	withIno.Flags |= AttrFlagExtended
+	withIno.Extensions = append(attr.Extensions[:len(attr.Extensions):len(attr.Extensions)],
+		Extension{InodeExtension, strconv.FormatUint(ino, 10)})
+	return &withIno
+}
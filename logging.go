@@ -0,0 +1,78 @@
+package sftp
+
+import (
+	"fmt"
+	"time"
+)
+
+// A Logger receives diagnostic messages from the server. *log.Logger satisfies
+// this interface.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// logf logs a message if a Logger is configured.
+func (s *server) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
+
+// checkSlowOp logs the given request if handling it, which began at start,
+// took longer than the configured threshold.
+func (s *server) checkSlowOp(pkt requestPacket, start time.Time) {
+	if s.SlowOpThreshold <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed > s.SlowOpThreshold {
+		s.logf("sftp: slow operation: %s took %v", describeRequest(pkt), elapsed)
+	}
+}
+
+// describeRequest summarizes a request's type and target for logging.
+func describeRequest(pkt requestPacket) string {
+	switch pkt := pkt.(type) {
+	case *fxpOpenPkt:
+		return fmt.Sprintf("%v %q", fxp(fxpOpen), pkt.Path)
+	case *fxpClosePkt:
+		return fmt.Sprintf("%v handle %s", fxp(fxpClose), pkt.Handle)
+	case *fxpReadPkt:
+		return fmt.Sprintf("%v handle %s [offset=%d len=%d]", fxp(fxpRead), pkt.Handle, pkt.Offset, pkt.Len)
+	case *fxpWritePkt:
+		return fmt.Sprintf("%v handle %s [offset=%d len=%d]", fxp(fxpWrite), pkt.Handle, pkt.Offset, len(pkt.Data))
+	case *fxpLstatPkt:
+		return fmt.Sprintf("%v %q", fxp(fxpLstat), pkt.Path)
+	case *fxpFstatPkt:
+		return fmt.Sprintf("%v handle %s", fxp(fxpFstat), pkt.Handle)
+	case *fxpSetstatPkt:
+		return fmt.Sprintf("%v %q", fxp(fxpSetstat), pkt.Path)
+	case *fxpFsetstatPkt:
+		return fmt.Sprintf("%v handle %s", fxp(fxpFsetstat), pkt.Handle)
+	case *fxpOpendirPkt:
+		return fmt.Sprintf("%v %q", fxp(fxpOpendir), pkt.Path)
+	case *fxpReaddirPkt:
+		return fmt.Sprintf("%v handle %s", fxp(fxpReaddir), pkt.Handle)
+	case *fxpRemovePkt:
+		return fmt.Sprintf("%v %q", fxp(fxpRemove), pkt.Path)
+	case *fxpMkdirPkt:
+		return fmt.Sprintf("%v %q", fxp(fxpMkdir), pkt.Path)
+	case *fxpRmdirPkt:
+		return fmt.Sprintf("%v %q", fxp(fxpRmdir), pkt.Path)
+	case *fxpRealpathPkt:
+		return fmt.Sprintf("%v %q", fxp(fxpRealpath), pkt.Path)
+	case *fxpStatPkt:
+		return fmt.Sprintf("%v %q", fxp(fxpStat), pkt.Path)
+	case *fxpRenamePkt:
+		return fmt.Sprintf("%v %q to %q", fxp(fxpRename), pkt.OldPath, pkt.NewPath)
+	case *fxpReadlinkPkt:
+		return fmt.Sprintf("%v %q", fxp(fxpReadlink), pkt.Path)
+	case *fxpSymlinkPkt:
+		return fmt.Sprintf("%v %q to %q", fxp(fxpSymlink), pkt.LinkPath, pkt.TargetPath)
+	case *fxpExtPosixRenamePkt:
+		return fmt.Sprintf("posix-rename@openssh.com %q to %q", pkt.OldPath, pkt.NewPath)
+	case *fxpExtStatvfsPkt:
+		return fmt.Sprintf("statvfs@openssh.com %q", pkt.Path)
+	default:
+		return fmt.Sprintf("%T", pkt)
+	}
+}
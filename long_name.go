@@ -1,8 +1,8 @@
 package sftp
 
 import (
-	"fmt"
 	"os"
+	"strings"
 )
 
 func runLsTypeWord(f os.FileInfo) string {
@@ -31,65 +31,63 @@ func runLsTypeWord(f os.FileInfo) string {
 		tc = 'p'
 	}
 
-	// owner
-	orc := '-'
-	if (mode & 0400) != 0 {
-		orc = 'r'
-	}
-	owc := '-'
-	if (mode & 0200) != 0 {
-		owc = 'w'
-	}
-	oxc := '-'
-	ox := (mode & 0100) != 0
-	setuid := (mode & os.ModeSetuid) != 0
-	if ox && setuid {
-		oxc = 's'
-	} else if setuid {
-		oxc = 'S'
-	} else if ox {
-		oxc = 'x'
-	}
+	word := [10]byte{byte(tc), '-', '-', '-', '-', '-', '-', '-', '-', '-'}
+	runLsPermTriple(word[1:4], mode>>6, mode&os.ModeSetuid != 0, 's')
+	runLsPermTriple(word[4:7], mode>>3, mode&os.ModeSetgid != 0, 's')
+	runLsPermTriple(word[7:10], mode, mode&os.ModeSticky != 0, 't')
+	return string(word[:])
+}
 
-	// group
-	grc := '-'
-	if (mode & 040) != 0 {
-		grc = 'r'
+// runLsPermTriple fills in the "rwx" characters of one of the owner, group or
+// others permission triples, whose bits are the lowest three of perm. special
+// is the setuid, setgid or sticky bit shown in place of 'x', as the lowercase
+// specialc if 'x' is also set, or otherwise uppercase.
+func runLsPermTriple(dst []byte, perm os.FileMode, special bool, specialc byte) {
+	if perm&04 != 0 {
+		dst[0] = 'r'
 	}
-	gwc := '-'
-	if (mode & 020) != 0 {
-		gwc = 'w'
+	if perm&02 != 0 {
+		dst[1] = 'w'
 	}
-	gxc := '-'
-	gx := (mode & 010) != 0
-	setgid := (mode & os.ModeSetgid) != 0
-	if gx && setgid {
-		gxc = 's'
-	} else if setgid {
-		gxc = 'S'
-	} else if gx {
-		gxc = 'x'
+	switch x := perm&01 != 0; {
+	case x && special:
+		dst[2] = specialc
+	case special:
+		dst[2] = specialc - 'a' + 'A'
+	case x:
+		dst[2] = 'x'
 	}
+}
 
-	// all / others
-	arc := '-'
-	if (mode & 04) != 0 {
-		arc = 'r'
-	}
-	awc := '-'
-	if (mode & 02) != 0 {
-		awc = 'w'
+// runLsFormat assembles an ls -l style long name from its fields, as
+// fmt.Sprintf("%s %4s %-8s %-8s %8s %s %2s %5s %s", ...) would, but without
+// an allocation per field, since a long name is built for every entry listed.
+func runLsFormat(typeword, numLinks, username, groupname, size, month, day, yearOrTime, name string) string {
+	var b strings.Builder
+	b.Grow(len(typeword) + len(username) + len(groupname) + len(size) + len(name) + 40)
+	fields := [...]struct {
+		s     string
+		width int // negative to pad on the right
+	}{
+		{typeword, 0}, {numLinks, 4}, {username, -8}, {groupname, -8}, {size, 8},
+		{month, 0}, {day, 2}, {yearOrTime, 5}, {name, 0},
 	}
-	axc := '-'
-	ax := (mode & 01) != 0
-	sticky := (mode & os.ModeSticky) != 0
-	if ax && sticky {
-		axc = 't'
-	} else if sticky {
-		axc = 'T'
-	} else if ax {
-		axc = 'x'
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		pad := f.width
+		if pad < 0 {
+			pad = -pad
+		}
+		pad -= len(f.s)
+		for ; f.width > 0 && pad > 0; pad-- {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f.s)
+		for ; f.width < 0 && pad > 0; pad-- {
+			b.WriteByte(' ')
+		}
 	}
-
-	return fmt.Sprintf("%c%c%c%c%c%c%c%c%c%c", tc, orc, owc, oxc, grc, gwc, gxc, arc, awc, axc)
+	return b.String()
 }
@@ -0,0 +1,84 @@
+package sftp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultMaxNameLen is the default for ServerOpts.MaxNameLen.
+const defaultMaxNameLen = 255
+
+// checkNames validates the paths in the given request before it is passed to
+// the handler. Paths which the request may create are also checked against
+// MaxNameLen.
+func (s *server) checkNames(pkt requestPacket) error {
+	switch pkt := pkt.(type) {
+	case *fxpOpenPkt:
+		return s.checkName(pkt.Path, true)
+	case *fxpMkdirPkt:
+		return s.checkName(pkt.Path, true)
+	case *fxpRenamePkt:
+		if err := s.checkName(pkt.OldPath, false); err != nil {
+			return err
+		}
+		return s.checkName(pkt.NewPath, true)
+	case *fxpExtPosixRenamePkt:
+		if err := s.checkName(pkt.OldPath, false); err != nil {
+			return err
+		}
+		return s.checkName(pkt.NewPath, true)
+	case *fxpSymlinkPkt:
+		// The target need not exist, nor be valid on this server, but it is
+		// still passed to the OS, which cannot represent a NUL
+		if strings.IndexByte(pkt.TargetPath, 0) >= 0 {
+			return ErrInvalidFilename.WithMessage("name contains a NUL byte")
+		}
+		return s.checkName(pkt.LinkPath, true)
+	case *fxpRemovePkt:
+		return s.checkName(pkt.Path, false)
+	case *fxpRmdirPkt:
+		return s.checkName(pkt.Path, false)
+	case *fxpOpendirPkt:
+		return s.checkName(pkt.Path, false)
+	case *fxpStatPkt:
+		return s.checkName(pkt.Path, false)
+	case *fxpLstatPkt:
+		return s.checkName(pkt.Path, false)
+	case *fxpSetstatPkt:
+		return s.checkName(pkt.Path, false)
+	case *fxpReadlinkPkt:
+		return s.checkName(pkt.Path, false)
+	case *fxpRealpathPkt:
+		return s.checkName(pkt.Path, false)
+	case *fxpExtStatvfsPkt:
+		return s.checkName(pkt.Path, false)
+	}
+	return nil
+}
+
+// checkName validates each component of the given path. NUL bytes, which no
+// OS permits in a name and which C-based backends would treat as the end of
+// the path, and any of DisallowedNameChars are refused. If creating, the
+// length of each component is limited to MaxNameLen.
+func (s *server) checkName(p string, creating bool) error {
+	if strings.IndexByte(p, 0) >= 0 {
+		return ErrInvalidFilename.WithMessage("name contains a NUL byte")
+	}
+	if s.DisallowedNameChars != "" && strings.ContainsAny(p, s.DisallowedNameChars) {
+		return ErrInvalidFilename.WithMessage("name contains a disallowed character")
+	}
+
+	maxLen := s.MaxNameLen
+	if maxLen == 0 {
+		maxLen = defaultMaxNameLen
+	}
+	if !creating || maxLen < 0 {
+		return nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		if len(name) > maxLen {
+			return ErrInvalidFilename.WithMessage(fmt.Sprintf("name exceeds %d bytes", maxLen))
+		}
+	}
+	return nil
+}
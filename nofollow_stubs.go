@@ -0,0 +1,16 @@
+// +build windows plan9 js
+
+package sftp
+
+import "os"
+
+// oNoFollow is zero since this OS has no O_NOFOLLOW equivalent.
+const oNoFollow = 0
+
+// oNonBlock is zero since this OS has no FIFOs which could block opening.
+const oNonBlock = 0
+
+// clearNonBlock does nothing, since oNonBlock is zero.
+func clearNonBlock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,30 @@
+// +build !windows,!plan9,!js
+
+package sftp
+
+import (
+	"os"
+	"syscall"
+)
+
+// oNoFollow is the open flag which refuses to follow a final symbolic link.
+const oNoFollow = syscall.O_NOFOLLOW
+
+// oNonBlock is the open flag which stops opening a FIFO from blocking until
+// the other end is opened.
+const oNonBlock = syscall.O_NONBLOCK
+
+// clearNonBlock puts a file opened with oNonBlock back into blocking mode.
+func clearNonBlock(f *os.File) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err = conn.Control(func(fd uintptr) {
+		serr = syscall.SetNonblock(int(fd), false)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -10,30 +10,42 @@ import (
 const sftpServerWorkerCount = 8
 
 // packetManager ensures outgoing packets are in the same order as the incoming
-// per section 7 of the RFC.
+// per section 7 of the RFC. If fair, reads and writes on different handles are
+// instead served round-robin, and their replies are only kept in order
+// relative to other requests on the same handle and to all other requests.
 type packetManager struct {
 	requests  chan orderedPacket
 	responses chan orderedPacket
 	fini      chan struct{}
+	done      chan struct{} // closed once every response has been written
 	incoming  []orderedPacket
 	outgoing  []orderedPacket
 	writer    io.Writer // connection
 	working   *sync.WaitGroup
 	counter   uint
+	fair      bool
+
+	// pending counts the requests which have not yet been taken up: reads
+	// and writes until a worker receives them, and others until they are
+	// dispatched, which may wait on the reads and writes before them
+	pending sync.WaitGroup
 }
 
-func newPktMgr(writer io.Writer) *packetManager {
+func newPktMgr(writer io.Writer, fair bool) *packetManager {
 	s := &packetManager{
 		requests:  make(chan orderedPacket, sftpServerWorkerCount),
 		responses: make(chan orderedPacket, sftpServerWorkerCount),
 		fini:      make(chan struct{}),
+		done:      make(chan struct{}),
 		incoming:  make([]orderedPacket, 0, sftpServerWorkerCount),
 		outgoing:  make([]orderedPacket, 0, sftpServerWorkerCount),
 		writer:    writer,
 		working:   &sync.WaitGroup{},
+		fair:      fair,
 	}
 
 	go func() {
+		defer close(s.done)
 		for {
 			select {
 			case pkt := <-s.requests:
@@ -43,6 +55,7 @@ func newPktMgr(writer io.Writer) *packetManager {
 				s.outgoing = append(s.outgoing, pkt)
 				sortPackets(s.outgoing)
 			case <-s.fini:
+				s.drain()
 				return
 			}
 			s.sendReadyPackets()
@@ -79,9 +92,24 @@ func sortPackets(packets []orderedPacket) {
 
 func (s *packetManager) newOrderedRequest(p requestPacket) orderedRequest {
 	s.counter++
+	s.pending.Add(1)
 	return orderedRequest{p, s.counter}
 }
 
+// taken is called by a worker as it receives a request.
+func (s *packetManager) taken(pkt orderedRequest) {
+	switch pkt.requestPacket.(type) {
+	case *fxpReadPkt, *fxpWritePkt:
+		s.pending.Done()
+	}
+}
+
+// waitTaken waits until every request has been taken up, after which any still
+// being handled are either in the handler or waiting on those which are.
+func (s *packetManager) waitTaken() {
+	s.pending.Wait()
+}
+
 // register incoming packets to be handled
 func (s *packetManager) incomingPacket(pkt orderedRequest) {
 	s.working.Add(1)
@@ -101,6 +129,30 @@ func (s *packetManager) close() {
 	close(s.fini)
 }
 
+// wait waits until the packetManager has shut down, having written all
+// responses.
+func (s *packetManager) wait() {
+	<-s.done
+}
+
+// drain sends the responses which were ready before shutting down, but not yet
+// received from the channels.
+func (s *packetManager) drain() {
+	for {
+		select {
+		case pkt := <-s.requests:
+			s.incoming = append(s.incoming, pkt)
+			sortPackets(s.incoming)
+		case pkt := <-s.responses:
+			s.outgoing = append(s.outgoing, pkt)
+			sortPackets(s.outgoing)
+		default:
+			s.sendReadyPackets()
+			return
+		}
+	}
+}
+
 // Passed a worker function, returns a channel for incoming packets.
 // Keep process packet responses in the order they are received while
 // maximizing throughput of file transfers.
@@ -110,6 +162,19 @@ func (s *packetManager) workerChan(
 
 	// multiple workers for faster read/writes
 	rwChan := make(chan orderedRequest, sftpServerWorkerCount)
+	var fairRW *fairQueue
+	if s.fair {
+		// Requests wait in the fairQueue rather than the channel, so that the
+		// choice of which to serve next is made as late as possible
+		rwChan = make(chan orderedRequest)
+		fairRW = newFairQueue()
+		go func() {
+			for pkt, ok := fairRW.pop(); ok; pkt, ok = fairRW.pop() {
+				rwChan <- pkt
+			}
+			close(rwChan)
+		}()
+	}
 	for i := 0; i < sftpServerWorkerCount; i++ {
 		runWorker(rwChan)
 	}
@@ -124,18 +189,30 @@ func (s *packetManager) workerChan(
 			switch pkt.requestPacket.(type) {
 			case *fxpReadPkt, *fxpWritePkt:
 				s.incomingPacket(pkt)
-				rwChan <- pkt
+				if fairRW != nil {
+					handle, _ := rwHandle(pkt.requestPacket)
+					fairRW.push(handle, pkt)
+				} else {
+					rwChan <- pkt
+				}
 				continue
 			case *fxpClosePkt:
+				s.pending.Done()
 				// wait for reads/writes to finish when file is closed
 				// incomingPacket() call must occur after this
 				s.working.Wait()
+			default:
+				s.pending.Done()
 			}
 			s.incomingPacket(pkt)
 			// all non-RW use sequential cmdChan
 			cmdChan <- pkt
 		}
-		close(rwChan)
+		if fairRW != nil {
+			fairRW.close() // which closes rwChan once drained
+		} else {
+			close(rwChan)
+		}
 		close(cmdChan)
 		s.close()
 	}()
@@ -144,6 +221,22 @@ func (s *packetManager) workerChan(
 }
 
 func (s *packetManager) sendReadyPackets() {
+	sent := false
+	defer func() {
+		// Don't leave responses sitting in a buffered transport, but flush
+		// once per batch rather than after every packet
+		if f, ok := s.writer.(Flusher); ok && sent {
+			if err := f.Flush(); err != nil {
+				debug("Error flushing transport: %v", err)
+			}
+		}
+	}()
+
+	if s.fair {
+		sent = s.sendReorderablePackets()
+		return
+	}
+
 	for len(s.incoming) > 0 && len(s.outgoing) > 0 {
 		in := s.incoming[0]
 		out := s.outgoing[0]
@@ -152,13 +245,8 @@ func (s *packetManager) sendReadyPackets() {
 			break
 		}
 
-		// This will panic if the out packet type does not implement
-		// BinaryMarshaler but that is a bug anyways
-		if pkt, err := out.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
-			debug("Error marshaling packet: %v", err)
-		} else if _, err = s.writer.Write(pkt); err != nil {
-			debug("Error sending packet: %v", err)
-		}
+		s.writeResponse(out)
+		sent = true
 
 		// Shift queues
 		copy(s.incoming, s.incoming[1:])            // shift left
@@ -169,3 +257,49 @@ func (s *packetManager) sendReadyPackets() {
 		s.outgoing = s.outgoing[:len(s.outgoing)-1] // remove last
 	}
 }
+
+// sendReorderablePackets sends each ready response which no earlier, unanswered
+// request must be answered before, and reports whether any were sent.
+func (s *packetManager) sendReorderablePackets() (sent bool) {
+	for i := 0; i < len(s.outgoing); {
+		j := 0
+		for j < len(s.incoming) && s.incoming[j].orderID() != s.outgoing[i].orderID() {
+			j++
+		}
+		if j == len(s.incoming) || !s.mayAnswer(j) {
+			i++
+			continue
+		}
+
+		s.writeResponse(s.outgoing[i])
+		sent = true
+		s.incoming = append(s.incoming[:j], s.incoming[j+1:]...)
+		s.outgoing = append(s.outgoing[:i], s.outgoing[i+1:]...)
+		// Earlier responses cannot have been waiting on this one, since the
+		// outgoing queue is sorted, so carry on from the same index
+	}
+	return sent
+}
+
+// mayAnswer reports whether the incoming request at index j may be answered
+// before all the unanswered requests received before it.
+func (s *packetManager) mayAnswer(j int) bool {
+	req := s.incoming[j].(orderedRequest).requestPacket
+	for _, earlier := range s.incoming[:j] {
+		if !mayReorder(earlier.(orderedRequest).requestPacket, req) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeResponse marshals and writes a response to the client.
+func (s *packetManager) writeResponse(out orderedPacket) {
+	// This will panic if the out packet type does not implement
+	// BinaryMarshaler but that is a bug anyways
+	if pkt, err := out.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		debug("Error marshaling packet: %v", err)
+	} else if _, err = s.writer.Write(pkt); err != nil {
+		debug("Error sending packet: %v", err)
+	}
+}
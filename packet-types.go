@@ -109,6 +109,87 @@ func (f fxp) String() string {
 	}
 }
 
+// parseOps converts the names of packet types, as returned by fxp.String, to a
+// set of request types, failing if any is not the name of a request.
+func parseOps(names []string) (map[fxp]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	ops := make(map[fxp]bool, len(names))
+	for _, name := range names {
+		op, ok := requestTypeByName(name)
+		if !ok {
+			return nil, errors.Errorf("sftp: unknown request type %q", name)
+		}
+		ops[op] = true
+	}
+	return ops, nil
+}
+
+func requestTypeByName(name string) (fxp, bool) {
+	if name == fxp(fxpExtended).String() {
+		return fxpExtended, true
+	}
+	for op := fxp(fxpOpen); op <= fxpSymlink; op++ {
+		if op.String() == name {
+			return op, true
+		}
+	}
+	return 0, false
+}
+
+// requestType returns the type of the given request. Extended requests which
+// are variants of a standard request, e.g. "posix-rename@openssh.com", are of
+// that request's type. Anything else, e.g. an invalidRequestPkt, is of type 0,
+// so that it is never taken for a disabled request.
+func requestType(pkt requestPacket) fxp {
+	switch pkt.(type) {
+	case *fxpInitPkt:
+		return fxpInit
+	case *fxpOpenPkt:
+		return fxpOpen
+	case *fxpClosePkt:
+		return fxpClose
+	case *fxpReadPkt:
+		return fxpRead
+	case *fxpWritePkt:
+		return fxpWrite
+	case *fxpLstatPkt:
+		return fxpLstat
+	case *fxpFstatPkt:
+		return fxpFstat
+	case *fxpSetstatPkt:
+		return fxpSetstat
+	case *fxpFsetstatPkt:
+		return fxpFsetstat
+	case *fxpOpendirPkt:
+		return fxpOpendir
+	case *fxpReaddirPkt:
+		return fxpReaddir
+	case *fxpRemovePkt:
+		return fxpRemove
+	case *fxpMkdirPkt:
+		return fxpMkdir
+	case *fxpRmdirPkt:
+		return fxpRmdir
+	case *fxpRealpathPkt:
+		return fxpRealpath
+	case *fxpStatPkt:
+		return fxpStat
+	case *fxpRenamePkt, *fxpExtPosixRenamePkt:
+		return fxpRename
+	case *fxpReadlinkPkt:
+		return fxpReadlink
+	case *fxpSymlinkPkt:
+		return fxpSymlink
+	case *fxpExtendedPkt, *fxpExtStatvfsPkt, *fxpExtHomeDirectoryPkt,
+		*fxpExtUsersGroupsByIDPkt, *fxpExtVendorIDPkt, *fxpExtCustomPkt:
+		return fxpExtended
+	default:
+		return 0
+	}
+}
+
 type ider interface {
 	id() uint32
 }
@@ -125,8 +206,39 @@ type responsePacket interface {
 	ider
 }
 
-// take raw incoming packet data and build packet objects
-func makePacket(pktType fxp, pktData []byte) (requestPacket, error) {
+// invalidRequestPkt stands in for a request which could not be decoded, so that
+// the client can still be sent an error status for its ID.
+type invalidRequestPkt struct {
+	ID  uint32
+	err error
+}
+
+func (p *invalidRequestPkt) id() uint32 { return p.ID }
+
+func (p *invalidRequestPkt) UnmarshalBinary(b []byte) (err error) {
+	p.ID, _, err = takeU32(b)
+	return
+}
+
+// invalidRequest builds the packet to process in place of one which failed to
+// decode with the given error. Unknown packet types are reported as
+// unsupported, and anything else as a bad message. An error is returned if
+// even the request ID cannot be decoded, since then there is no way to reply.
+func invalidRequest(pktType fxp, pktData []byte, err error) (requestPacket, error) {
+	pkt := &invalidRequestPkt{err: ErrBadMessage.WithMessage(err.Error())}
+	if errors.Cause(err) == errUnknownPacketType {
+		pkt.err = ErrOpUnsupported
+	}
+	if uerr := pkt.UnmarshalBinary(pktData); uerr != nil {
+		return nil, errors.Wrapf(err, "undecodable %v packet", pktType)
+	}
+	return pkt, nil
+}
+
+// take raw incoming packet data and build packet objects. Extended requests are
+// only decoded if their name is allowed by extAllowed, and symlinkSpec selects
+// the order of SSH_FXP_SYMLINK paths.
+func makePacket(pktType fxp, pktData []byte, extAllowed func(name string) bool, symlinkSpec bool) (requestPacket, error) {
 	var pkt requestPacket
 
 	switch pktType {
@@ -167,11 +279,11 @@ func makePacket(pktType fxp, pktData []byte) (requestPacket, error) {
 	case fxpReadlink:
 		pkt = &fxpReadlinkPkt{}
 	case fxpSymlink:
-		pkt = &fxpSymlinkPkt{}
+		pkt = &fxpSymlinkPkt{FollowSpec: symlinkSpec}
 	case fxpExtended:
-		pkt = &fxpExtendedPkt{}
+		return decodeExtended(pktData, extAllowed)
 	default:
-		return nil, errors.Errorf("unknown packet type: %d", pktType)
+		return nil, errors.Wrapf(errUnknownPacketType, "%d", pktType)
 	}
 
 	// If an error occurs, still return the partially unpacked packet to allow callers
@@ -11,6 +11,8 @@ import (
 
 var (
 	errShortPacket           = errors.New("packet too short")
+	errLongPacket            = errors.New("packet too long")
+	errUnknownPacketType     = errors.New("unknown packet type")
 	errUnknownExtendedPacket = errors.New("unknown extended packet")
 )
 
@@ -85,6 +87,16 @@ func takeU64(b []byte) (uint64, []byte, error) {
 	return 0, nil, errShortPacket
 }
 
+// checkCount verifies that count items, each encoded in at least minSize bytes,
+// could fit in the remaining data, so that an attacker-controlled count cannot
+// trigger a huge allocation.
+func checkCount(count uint32, minSize int, b []byte) error {
+	if uint64(count)*uint64(minSize) > uint64(len(b)) {
+		return errShortPacket
+	}
+	return nil
+}
+
 func takeStr(b []byte) (string, []byte, error) {
 	n, b, err := takeU32(b)
 	if err != nil {
@@ -140,6 +152,10 @@ func takeAttr(b []byte) (_ *FileAttr, _ []byte, err error) {
 		if count, b, err = takeU32(b); err != nil {
 			return
 		}
+		// Each extension is at least two empty strings
+		if err = checkCount(count, 4+4, b); err != nil {
+			return
+		}
 
 		attr.Extensions = make([]Extension, count)
 		for i := uint32(0); i < count; i++ {
@@ -208,16 +224,31 @@ func writePacket(w io.Writer, pkt encoding.BinaryMarshaler) error {
 }
 
 // readPacket reads a single SFTP packet and returns the raw type and
-// data. The data will need to be interpreted depending on the type.
+// data. The data will need to be interpreted depending on the type. Reaching
+// EOF before the packet begins returns io.EOF, but reaching it partway through
+// returns ErrTruncatedPacket.
 func readPacket(r io.Reader) (uint8, []byte, error) {
 	b := make([]byte, 4)
 	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrTruncatedPacket
+		}
 		return 0, nil, err
 	}
 	pktLen := binary.BigEndian.Uint32(b)
+	if pktLen == 0 {
+		// Every packet has at least a type byte
+		return 0, nil, errShortPacket
+	}
+	if pktLen > maxPacketLength {
+		return 0, nil, errLongPacket
+	}
 	b = make([]byte, pktLen)
 	if _, err := io.ReadFull(r, b); err != nil {
 		debug("readPacket [length=%d]: error: %v", pktLen, err)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrTruncatedPacket
+		}
 		return 0, nil, err
 	}
 	debug("readPacket [type=%s]: %x", fxp(b[0]), b[1:])
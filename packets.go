@@ -132,6 +132,12 @@ func (p *fxpOpenPkt) UnmarshalBinary(b []byte) (err error) {
 	}
 	p.PFlags = pflag(pflags)
 
+	if len(b) == 0 {
+		// The attributes are required, but some minimal clients omit them
+		// entirely, which is taken to mean that none are specified
+		p.Attr = &FileAttr{}
+		return
+	}
 	if p.Attr, b, err = takeAttr(b); err != nil {
 		return
 	}
@@ -640,6 +646,10 @@ func (p *fxpNamePkt) UnmarshalBinary(b []byte) (err error) {
 	if count, b, err = takeU32(b); err != nil {
 		return
 	}
+	// Each item is at least two empty strings and attribute flags
+	if err = checkCount(count, 4+4+4, b); err != nil {
+		return
+	}
 
 	p.Items = make([]fxpNamePktItem, count)
 	for i := uint32(0); i < count; i++ {
@@ -678,15 +688,23 @@ func (p *fxpAttrPkt) UnmarshalBinary(b []byte) (err error) {
 	return
 }
 
-// fxpExtendedReplyPkt is the overarching shape of extended reply packets. It
-// does not implement encoding.BinaryMarshaler because the specific extended
-// packet types should be able to marshal themselves completely (i.e. including
-// an SSH_FXP_EXTENDED_REPLY byte).
+// fxpExtendedReplyPkt is the overarching shape of extended reply packets. The
+// specific extended reply types marshal themselves completely (i.e. including
+// an SSH_FXP_EXTENDED_REPLY byte), but this is also used directly to reply to
+// custom extensions with arbitrary data.
 type fxpExtendedReplyPkt struct {
 	ID   uint32
 	Data []byte
 }
 
+func (p *fxpExtendedReplyPkt) id() uint32 { return p.ID }
+
+func (p *fxpExtendedReplyPkt) MarshalBinary() ([]byte, error) {
+	b := allocPkt(fxpExtendedReply, 4+len(p.Data))
+	b = appendU32(b, p.ID)
+	return append(b, p.Data...), nil
+}
+
 func (p *fxpExtendedReplyPkt) UnmarshalBinary(b []byte) (err error) {
 	p.ID, p.Data, err = takeU32(b)
 	return
@@ -6,11 +6,15 @@ package sftp
 //
 // 		- "posix-rename@openssh.com"
 //		- "statvfs@openssh.com"
+//		- "home-directory"
+//		- "users-groups-by-id@openssh.com"
+//		- "vendor-id"
 //		- TODO(samterainsights): "fstatvfs@openssh.com"
 //		- TODO(samterainsights): "hardlink@openssh.com"
 //		- TODO(samterainsights): "fsync@openssh.com"
 //
-// Please add to this list if you implement another extended packet.
+// Please add to this list if you implement another extended packet, and register
+// it in extensions.go.
 
 // fxpExtPosixRenamePkt is an extended "posix-rename@openssh.com" request packet. It
 // defers from SSH_FXP_RENAME in that POSIX renames are guaranteed to be atomic and
@@ -140,7 +144,7 @@ type StatVFS struct {
 	BlocksAvail uint64 // free blocks for non-root
 	Files       uint64 // total file inodes
 	FilesFree   uint64 // free file inodes
-	FilesAvail  uint64 // free file inodes for to non-root
+	FilesAvail  uint64 // free file inodes for non-root, which is FilesFree on Linux and macOS
 	FSID        uint64 // file system id
 	Flag        uint64 // bit mask of f_flag values
 	MaxNameLen  uint64 // maximum filename length
@@ -165,3 +169,207 @@ func (fs *StatVFS) Readonly() bool {
 func (fs *StatVFS) SupportsSetUID() bool {
 	return fs.Flag&vfsFlagNoSetUID == 0
 }
+
+// fxpExtHomeDirectoryPkt is an extended "home-directory" request packet. It is
+// used to resolve the home directory of the given user, or of the session's
+// user if the username is empty, e.g. to expand "~" in paths. The reply is an
+// SSH_FXP_NAME with a single name.
+type fxpExtHomeDirectoryPkt struct {
+	ID       uint32 // set externally from the SSH_FXP_EXTENDED wrapper
+	Username string
+}
+
+func (p *fxpExtHomeDirectoryPkt) id() uint32 { return p.ID }
+
+func (p *fxpExtHomeDirectoryPkt) MarshalBinary() ([]byte, error) {
+	const ext = "home-directory"
+	b := allocPkt(fxpExtended, 4+(4+len(ext))+(4+len(p.Username)))
+	b = appendU32(b, p.ID)
+	b = appendStr(b, ext)
+	return appendStr(b, p.Username), nil
+}
+
+func (p *fxpExtHomeDirectoryPkt) UnmarshalBinary(b []byte) (err error) {
+	p.Username, _, err = takeStr(b)
+	return
+}
+
+// fxpExtUsersGroupsByIDPkt is an extended "users-groups-by-id@openssh.com"
+// request packet. It is used to resolve the names of users and groups whose
+// IDs the client has seen, e.g. in SSH_FXP_READDIR replies. Each list of IDs is
+// sent as a string of concatenated uint32s.
+type fxpExtUsersGroupsByIDPkt struct {
+	ID   uint32 // set externally from the SSH_FXP_EXTENDED wrapper
+	UIDs []uint32
+	GIDs []uint32
+}
+
+func (p *fxpExtUsersGroupsByIDPkt) id() uint32 { return p.ID }
+
+func (p *fxpExtUsersGroupsByIDPkt) MarshalBinary() ([]byte, error) {
+	const ext = "users-groups-by-id@openssh.com"
+	b := allocPkt(fxpExtended, 4+(4+len(ext))+(4+4*len(p.UIDs))+(4+4*len(p.GIDs)))
+	b = appendU32(b, p.ID)
+	b = appendStr(b, ext)
+	b = appendIDList(b, p.UIDs)
+	return appendIDList(b, p.GIDs), nil
+}
+
+func (p *fxpExtUsersGroupsByIDPkt) UnmarshalBinary(b []byte) (err error) {
+	if p.UIDs, b, err = takeIDList(b); err != nil {
+		return
+	}
+	p.GIDs, _, err = takeIDList(b)
+	return
+}
+
+func appendIDList(b []byte, ids []uint32) []byte {
+	b = appendU32(b, uint32(4*len(ids)))
+	for _, id := range ids {
+		b = appendU32(b, id)
+	}
+	return b
+}
+
+func takeIDList(b []byte) ([]uint32, []byte, error) {
+	n, b, err := takeU32(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n%4 != 0 || int64(n) > int64(len(b)) {
+		return nil, nil, errShortPacket
+	}
+	ids := make([]uint32, n/4)
+	for i := range ids {
+		ids[i], b, _ = takeU32(b)
+	}
+	return ids, b, nil
+}
+
+// fxpExtUsersGroupsByIDReplyPkt is the success reply to a
+// "users-groups-by-id@openssh.com" request. It contains one name per requested
+// ID, in the same order, with an empty name for IDs which could not be
+// resolved. Each list of names is sent as a string of concatenated strings.
+type fxpExtUsersGroupsByIDReplyPkt struct {
+	ID         uint32
+	Usernames  []string
+	Groupnames []string
+}
+
+func (p *fxpExtUsersGroupsByIDReplyPkt) id() uint32 { return p.ID }
+
+func (p *fxpExtUsersGroupsByIDReplyPkt) MarshalBinary() ([]byte, error) {
+	b := allocPkt(fxpExtendedReply, 4+(4+nameListSize(p.Usernames))+(4+nameListSize(p.Groupnames)))
+	b = appendU32(b, p.ID)
+	b = appendNameList(b, p.Usernames)
+	return appendNameList(b, p.Groupnames), nil
+}
+
+func (p *fxpExtUsersGroupsByIDReplyPkt) UnmarshalBinary(b []byte) (err error) {
+	if p.ID, b, err = takeU32(b); err != nil {
+		return
+	}
+	if p.Usernames, b, err = takeNameList(b); err != nil {
+		return
+	}
+	p.Groupnames, _, err = takeNameList(b)
+	return
+}
+
+func nameListSize(names []string) int {
+	size := 0
+	for _, name := range names {
+		size += 4 + len(name)
+	}
+	return size
+}
+
+func appendNameList(b []byte, names []string) []byte {
+	b = appendU32(b, uint32(nameListSize(names)))
+	for _, name := range names {
+		b = appendStr(b, name)
+	}
+	return b
+}
+
+func takeNameList(b []byte) ([]string, []byte, error) {
+	n, b, err := takeU32(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(n) > int64(len(b)) {
+		return nil, nil, errShortPacket
+	}
+	list, b := b[:n], b[n:]
+
+	var names []string
+	for len(list) > 0 {
+		var name string
+		if name, list, err = takeStr(list); err != nil {
+			return nil, nil, err
+		}
+		names = append(names, name)
+	}
+	return names, b, nil
+}
+
+// fxpExtVendorIDPkt is an extended "vendor-id" request packet, with which a
+// client identifies its own implementation. The reply is an
+// SSH_FXP_EXTENDED_REPLY identifying the server's. Since the client's identity
+// is informational only, it may be omitted, and is ignored if malformed.
+type fxpExtVendorIDPkt struct {
+	ID uint32 // set externally from the SSH_FXP_EXTENDED wrapper
+	VendorID
+}
+
+func (p *fxpExtVendorIDPkt) id() uint32 { return p.ID }
+
+func (p *fxpExtVendorIDPkt) MarshalBinary() ([]byte, error) {
+	const ext = "vendor-id"
+	b := allocPkt(fxpExtended, 4+(4+len(ext))+p.encodedSize())
+	b = appendU32(b, p.ID)
+	b = appendStr(b, ext)
+	return appendVendorID(b, p.VendorID), nil
+}
+
+func (p *fxpExtVendorIDPkt) UnmarshalBinary(b []byte) error {
+	p.VendorID, _, _ = takeVendorID(b)
+	return nil
+}
+
+// fxpExtVendorIDReplyPkt is the success reply to a "vendor-id" request.
+type fxpExtVendorIDReplyPkt struct {
+	ID uint32
+	VendorID
+}
+
+func (p *fxpExtVendorIDReplyPkt) id() uint32 { return p.ID }
+
+func (p *fxpExtVendorIDReplyPkt) MarshalBinary() ([]byte, error) {
+	b := allocPkt(fxpExtendedReply, 4+p.encodedSize())
+	b = appendU32(b, p.ID)
+	return appendVendorID(b, p.VendorID), nil
+}
+
+func (p *fxpExtVendorIDReplyPkt) UnmarshalBinary(b []byte) (err error) {
+	if p.ID, b, err = takeU32(b); err != nil {
+		return
+	}
+	p.VendorID, _, err = takeVendorID(b)
+	return
+}
+
+// fxpExtCustomPkt is an extended request registered via RegisterExtension. Its
+// data is left raw for the registered ExtensionHandlerFunc to interpret.
+type fxpExtCustomPkt struct {
+	ID     uint32 // set externally from the SSH_FXP_EXTENDED wrapper
+	Data   []byte
+	handle ExtensionHandlerFunc
+}
+
+func (p *fxpExtCustomPkt) id() uint32 { return p.ID }
+
+func (p *fxpExtCustomPkt) UnmarshalBinary(b []byte) error {
+	p.Data = b
+	return nil
+}
@@ -0,0 +1,43 @@
+package sftp
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// FuzzMakePacket decodes arbitrary packets as the server does, checking that
+// decoding never panics, that anything which fails to decode is replaced by an
+// invalidRequestPkt unless even its request ID is missing, and that anything
+// else has a request type. It is seeded with every packet type, and the corpus
+// in testdata/fuzz.
+func FuzzMakePacket(f *testing.F) {
+	for _, pkt := range samplePackets() {
+		b, _ := pkt.MarshalBinary()
+		f.Add(b[4], b[5:], false)
+	}
+	f.Add(byte(fxpSymlink), []byte("\x00\x00\x00\x01\x00\x00\x00\x01a\x00\x00\x00\x01b"), true)
+
+	allowAll := func(string) bool { return true }
+	f.Fuzz(func(t *testing.T, pktType byte, data []byte, symlinkSpec bool) {
+		pkt, err := makePacket(fxp(pktType), data, allowAll, symlinkSpec)
+		if err != nil && errors.Cause(err) != errUnknownExtendedPacket {
+			if pkt, err = invalidRequest(fxp(pktType), data, err); err != nil {
+				if len(data) >= 4 {
+					t.Fatalf("invalidRequest(%v, %x) failed despite a request ID: %v", fxp(pktType), data, err)
+				}
+				return
+			}
+			if _, ok := pkt.(*invalidRequestPkt); !ok {
+				t.Fatalf("invalidRequest(%v, %x) = %T, want *invalidRequestPkt", fxp(pktType), data, pkt)
+			}
+		}
+		if pkt == nil {
+			t.Fatalf("makePacket(%v, %x) returned neither a packet nor an error", fxp(pktType), data)
+		}
+		pkt.id()
+		if _, invalid := pkt.(*invalidRequestPkt); !invalid && requestType(pkt) == 0 {
+			t.Fatalf("makePacket(%v, %x) = %T, which has no request type", fxp(pktType), data, pkt)
+		}
+	})
+}
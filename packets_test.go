@@ -0,0 +1,191 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unframe checks the length prefix and type of a marshaled packet, and returns
+// the data which follows them.
+func unframe(t *testing.T, b []byte, pktType byte) []byte {
+	t.Helper()
+	if len(b) < 5 {
+		t.Fatalf("marshaled packet %x is shorter than its length prefix and type", b)
+	}
+	if n := binary.BigEndian.Uint32(b); int(n) != len(b)-4 {
+		t.Fatalf("marshaled packet has length prefix %d, want %d", n, len(b)-4)
+	}
+	if b[4] != pktType {
+		t.Fatalf("marshaled packet has type %d, want %d", b[4], pktType)
+	}
+	return b[5:]
+}
+
+func TestExtendedReplyRoundTrip(t *testing.T) {
+	for _, data := range [][]byte{nil, {0}, []byte("arbitrary reply data"), make([]byte, 1<<16)} {
+		b, err := (&fxpExtendedReplyPkt{ID: 42, Data: data}).MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+		var got fxpExtendedReplyPkt
+		if err := got.UnmarshalBinary(unframe(t, b, fxpExtendedReply)); err != nil {
+			t.Fatalf("UnmarshalBinary: %v", err)
+		}
+		if got.ID != 42 || !bytes.Equal(got.Data, data) {
+			t.Fatalf("round trip of %d bytes gave ID %d and %d bytes", len(data), got.ID, len(got.Data))
+		}
+	}
+}
+
+// TestMarshalLengthPrefix checks that every packet marshals itself with a
+// length prefix matching the length of the data which follows it.
+func TestMarshalLengthPrefix(t *testing.T) {
+	tested := make(map[string]bool)
+	for _, pkt := range samplePackets() {
+		name := reflect.TypeOf(pkt).Elem().Name()
+		tested[name] = true
+		b, err := pkt.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: MarshalBinary: %v", name, err)
+		} else if len(b) < 5 {
+			t.Errorf("%s: marshaled packet %x is shorter than its length prefix and type", name, b)
+		} else if n := binary.BigEndian.Uint32(b); int(n) != len(b)-4 {
+			t.Errorf("%s: length prefix is %d, want %d", name, n, len(b)-4)
+		}
+	}
+
+	for _, name := range marshalers(t) {
+		if !tested[name] {
+			t.Errorf("%s implements MarshalBinary but is not tested", name)
+		}
+	}
+}
+
+// samplePackets returns one of every packet type, populated with all fields.
+func samplePackets() []encoding.BinaryMarshaler {
+	attr := &FileAttr{
+		Flags:      AttrFlagSize | AttrFlagUIDGID | AttrFlagPermissions | AttrFlagAcModTime | AttrFlagExtended,
+		Size:       1 << 40,
+		UID:        1000,
+		GID:        1000,
+		Perms:      0644,
+		AcTime:     time.Unix(1e9, 0),
+		ModTime:    time.Unix(2e9, 0),
+		Extensions: []Extension{{"name@example.com", "data"}, {"", ""}},
+	}
+	exts := []Extension{{"posix-rename@openssh.com", "1"}, {"statvfs@openssh.com", "2"}}
+	id := VendorID{"Vendor", "Product", "v1.2.3", 4}
+	return []encoding.BinaryMarshaler{
+		&fxpInitPkt{3, exts},
+		&fxpVersionPkt{3, exts},
+		&fxpOpenPkt{1, "/path", PFlagRead | PFlagWrite, attr},
+		&fxpClosePkt{1, "handle"},
+		&fxpReadPkt{1, "handle", 1 << 33, 1 << 15},
+		&fxpWritePkt{1, "handle", 1 << 33, []byte("data")},
+		&fxpRemovePkt{1, "/path"},
+		&fxpRenamePkt{1, "/old", "/new"},
+		&fxpMkdirPkt{1, "/path", attr},
+		&fxpRmdirPkt{1, "/path"},
+		&fxpOpendirPkt{1, "/path"},
+		&fxpReaddirPkt{1, "handle"},
+		&fxpStatPkt{1, "/path"},
+		&fxpLstatPkt{1, "/path"},
+		&fxpFstatPkt{1, "handle"},
+		&fxpSetstatPkt{1, "/path", attr},
+		&fxpFsetstatPkt{1, "handle", attr},
+		&fxpReadlinkPkt{1, "/path"},
+		&fxpSymlinkPkt{false, 1, "/link", "/target"},
+		&fxpRealpathPkt{1, "/path"},
+		&fxpStatusPkt{1, Status{fxFailure, "message", "en"}},
+		&fxpHandlePkt{1, "handle"},
+		&fxpDataPkt{1, []byte("data")},
+		&fxpNamePkt{1, []fxpNamePktItem{{"a", "-rw-r--r-- a", attr}, {"b", "", &FileAttr{}}}},
+		&fxpAttrPkt{1, attr},
+		&fxpExtendedReplyPkt{1, []byte("data")},
+		&fxpExtPosixRenamePkt{1, "/old", "/new"},
+		&fxpExtStatvfsPkt{1, "/path"},
+		&fxpExtVfsPkt{1, StatVFS{BlockSize: 4096, MaxNameLen: 255}},
+		&fxpExtHomeDirectoryPkt{1, "user"},
+		&fxpExtUsersGroupsByIDPkt{1, []uint32{0, 1000}, []uint32{100}},
+		&fxpExtUsersGroupsByIDReplyPkt{1, []string{"root", "user"}, []string{""}},
+		&fxpExtVendorIDPkt{1, id},
+		&fxpExtVendorIDReplyPkt{1, id},
+	}
+}
+
+// marshalers returns the names of the types in this package with a
+// MarshalBinary method.
+func marshalers(t *testing.T) []string {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), ".", nil, 0)
+	if err != nil {
+		t.Fatalf("parsing package: %v", err)
+	}
+	var names []string
+	for path, file := range pkgs["sftp"].Files {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || fn.Name.Name != "MarshalBinary" {
+				continue
+			}
+			typ := fn.Recv.List[0].Type
+			if star, ok := typ.(*ast.StarExpr); ok {
+				typ = star.X
+			}
+			names = append(names, typ.(*ast.Ident).Name)
+		}
+	}
+	return names
+}
+
+// TestHugeCounts checks that counts which cannot fit in the rest of a packet
+// are rejected, rather than allocating space for them up front.
+func TestHugeCounts(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		decode func(b []byte) error
+		b      []byte
+	}{
+		{"SSH_FXP_NAME", func(b []byte) error {
+			return new(fxpNamePkt).UnmarshalBinary(b)
+		}, appendU32(appendU32(nil, 1), 0xffffffff)},
+		{"SSH_FXP_NAME with 1<<20 items", func(b []byte) error {
+			return new(fxpNamePkt).UnmarshalBinary(b)
+		}, appendU32(appendU32(nil, 1), 1<<20)},
+		{"SSH_FXP_NAME with one item", func(b []byte) error {
+			return new(fxpNamePkt).UnmarshalBinary(b)
+		}, appendAttr(appendStr(appendStr(appendU32(appendU32(nil, 1), 2), "a"), ""), &FileAttr{})},
+		{"attribute extensions", func(b []byte) error {
+			_, _, err := takeAttr(b)
+			return err
+		}, appendU32(appendU32(nil, uint32(AttrFlagExtended)), 0xffffffff)},
+		{"attribute extensions with one extension", func(b []byte) error {
+			_, _, err := takeAttr(b)
+			return err
+		}, appendStr(appendStr(appendU32(appendU32(nil, uint32(AttrFlagExtended)), 2), "name"), "data")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			err := tc.decode(tc.b)
+			runtime.ReadMemStats(&after)
+			if err != errShortPacket {
+				t.Fatalf("decoding %x: got error %v, want errShortPacket", tc.b, err)
+			}
+			if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+				t.Fatalf("decoding %x allocated %d bytes", tc.b, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+// +build linux
+
+package sftp
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocateFile allocates disk blocks for the first size bytes of the file
+// without changing its size.
+func preallocateFile(f *os.File, size int64) error {
+	return retryEINTR(func() error {
+		return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	})
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package sftp
+
+import "os"
+
+func preallocateFile(f *os.File, size int64) error {
+	return ErrOpUnsupported
+}
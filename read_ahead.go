@@ -0,0 +1,151 @@
+package sftp
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// ReadAhead wraps a FileHandle so that, while a client reads it sequentially,
+// the next chunk of the file is read from the underlying handle in the
+// background, ready for the client's next request. This is useful for
+// backends where each ReadAt call has high latency, since it overlaps that
+// latency with sending the previous chunk to the client.
+//
+// A read is sequential if it starts where the previous one ended. Any other
+// read, and any write or Setstat call, discards the chunk being read ahead, so
+// a client seeking around the file, or modifying it, always reads current data.
+// Sequential reads smaller than a chunk are served from the remainder of the
+// chunk until it is used up.
+func ReadAhead(f FileHandle) FileHandle {
+	return &readAheadFile{FileHandle: f}
+}
+
+type readAheadFile struct {
+	FileHandle
+	mtx     sync.Mutex
+	next    int64     // file offset at which the last read ended
+	pending *prefetch // chunk being read ahead, if any
+	wg      sync.WaitGroup
+}
+
+// prefetch is a chunk of a file read in the background.
+type prefetch struct {
+	offset int64
+	data   []byte
+	err    error
+	done   chan struct{} // closed once data and err are set
+}
+
+func (f *readAheadFile) ReadAt(dst []byte, offset int64) (int, error) {
+	return f.ReadAtContext(context.Background(), dst, offset)
+}
+
+// ReadAtContext passes the context through to the underlying handle, for reads
+// not served from the chunk read ahead, if it is a ContextReaderAt.
+func (f *readAheadFile) ReadAtContext(ctx context.Context, dst []byte, offset int64) (int, error) {
+	f.mtx.Lock()
+	p := f.pending
+	if p != nil && p.offset != offset {
+		p = nil
+	}
+	sequential := p != nil || offset == f.next
+	f.pending = nil
+	var rest *prefetch
+	if p != nil {
+		// Whatever of the chunk this read does not use is kept for the
+		// next, unless it is discarded meanwhile
+		rest = &prefetch{offset: offset + int64(len(dst)), done: make(chan struct{})}
+		f.pending = rest
+	}
+	f.next = offset + int64(len(dst))
+	f.mtx.Unlock()
+
+	var n int
+	var err error
+	if p != nil {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			close(rest.done)
+			return 0, ctx.Err()
+		}
+		if n = copy(dst, p.data); n == len(p.data) {
+			err = p.err
+		} else {
+			rest.data, rest.err = p.data[n:], p.err
+		}
+		close(rest.done)
+	}
+	if n < len(dst) && err == nil {
+		var m int
+		m, err = readAt(ctx, f.FileHandle, dst[n:], offset+int64(n))
+		n += m
+	}
+
+	if sequential && err == nil {
+		f.mtx.Lock()
+		if f.pending == nil || f.pending == rest && len(rest.data) == 0 {
+			f.prefetch(f.next)
+		}
+		f.mtx.Unlock()
+	}
+	return n, err
+}
+
+// prefetch starts reading the chunk at the given offset in the background. It
+// must be called with f.mtx held.
+func (f *readAheadFile) prefetch(offset int64) {
+	p := &prefetch{offset: offset, done: make(chan struct{})}
+	f.pending = p
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		buf := make([]byte, maxReadWriteSize)
+		n, err := readAt(context.Background(), f.FileHandle, buf, offset)
+		p.data, p.err = buf[:n], err
+		close(p.done)
+	}()
+}
+
+// discard drops the chunk being read ahead, if any, as it may be stale.
+func (f *readAheadFile) discard() {
+	f.mtx.Lock()
+	f.pending = nil
+	f.mtx.Unlock()
+}
+
+func (f *readAheadFile) WriteAt(data []byte, offset int64) (int, error) {
+	return f.WriteAtContext(context.Background(), data, offset)
+}
+
+// WriteAtContext passes the context through to the underlying handle if it is a
+// ContextWriterAt.
+func (f *readAheadFile) WriteAtContext(ctx context.Context, data []byte, offset int64) (int, error) {
+	f.discard()
+	return writeAt(ctx, f.FileHandle, data, offset)
+}
+
+func (f *readAheadFile) Setstat(attr *FileAttr) error {
+	f.discard()
+	return f.FileHandle.Setstat(attr)
+}
+
+// Stat stats the underlying handle, so that the wrapper does not hide whether
+// it is a FileStatter.
+func (f *readAheadFile) Stat() (os.FileInfo, error) {
+	return statFile(f.FileHandle)
+}
+
+// Flush flushes the underlying handle if it is a Flusher or Syncer.
+func (f *readAheadFile) Flush() error {
+	return flushFile(f.FileHandle)
+}
+
+// Close waits for any reads in the background to finish, then closes the
+// underlying handle.
+func (f *readAheadFile) Close() error {
+	f.discard()
+	f.wg.Wait()
+	return f.FileHandle.Close()
+}
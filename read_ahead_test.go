@@ -0,0 +1,103 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+)
+
+// countingReader counts the reads made of a FileHandle, and the bytes they
+// request.
+type countingReader struct {
+	FileHandle
+	mtx          sync.Mutex
+	reads, bytes int
+}
+
+func (f *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	f.mtx.Lock()
+	f.reads++
+	f.bytes += len(p)
+	f.mtx.Unlock()
+	return f.FileHandle.ReadAt(p, off)
+}
+
+// TestReadAheadSmallReads reads a file sequentially in requests smaller than
+// the chunk read ahead, and checks that each chunk is read from the underlying
+// handle only once, rather than being discarded after its first request.
+func TestReadAheadSmallReads(t *testing.T) {
+	content := make([]byte, 4*maxReadWriteSize)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	fs := MemFS()
+	f, err := fs.OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(content, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &countingReader{FileHandle: f}
+	ra := ReadAhead(backend)
+	var got []byte
+	buf := make([]byte, maxReadWriteSize/4)
+	for off := int64(0); ; off += int64(len(buf)) {
+		n, err := ra.ReadAt(buf, off)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("ReadAt(%d): %v", off, err)
+		}
+	}
+	if err := ra.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Fatalf("read %d bytes which differ from the file's %d", len(got), len(content))
+	}
+	// The first request, and the chunk read ahead past the end of the file,
+	// are read beyond the file's content
+	if limit := len(content) + len(buf) + maxReadWriteSize; backend.bytes > limit {
+		t.Fatalf("read %d bytes from the underlying handle in %d reads, want at most %d",
+			backend.bytes, backend.reads, limit)
+	}
+}
+
+// TestReadAheadWriteDiscards checks that a write between sequential reads
+// discards what remains of the chunk read ahead, so that the next read returns
+// the data written.
+func TestReadAheadWriteDiscards(t *testing.T) {
+	fs := MemFS()
+	f, err := fs.OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, 2*maxReadWriteSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	ra := ReadAhead(f)
+	defer ra.Close()
+
+	buf := make([]byte, 16)
+	for off := int64(0); off < 3*int64(len(buf)); off += int64(len(buf)) {
+		if _, err := ra.ReadAt(buf, off); err != nil {
+			t.Fatalf("ReadAt(%d): %v", off, err)
+		}
+	}
+	if _, err := ra.WriteAt([]byte("new data"), 3*int64(len(buf))); err != nil {
+		t.Fatal(err)
+	}
+	n, err := ra.ReadAt(buf, 3*int64(len(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:8]); n != len(buf) || got != "new data" {
+		t.Fatalf("read %q after writing %q", got, "new data")
+	}
+}
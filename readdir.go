@@ -0,0 +1,153 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// namedFileInfo overrides the name of an os.FileInfo.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedFileInfo) Name() string { return fi.name }
+
+func (fi namedFileInfo) attrExtensions() []Extension { return fileInfoExtensions(fi.FileInfo) }
+
+func (fi namedFileInfo) inode() (uint64, bool) { return fileInode(fi.FileInfo) }
+
+// entryName returns the name of a directory entry as sent in SSH_FXP_NAME,
+// which must be a bare file name. Any leading path is stripped in case a
+// DirReader yields entries named by their full path.
+func entryName(fi os.FileInfo) string {
+	name := fi.Name()
+	if i := strings.LastIndexByte(name, '/'); i >= 0 && i < len(name)-1 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// dotDirReader wraps a DirReader, yielding "." and ".." before any of the
+// wrapped reader's entries.
+type dotDirReader struct {
+	DirReader
+	dots []os.FileInfo
+}
+
+// withDotEntries wraps the given DirReader for the directory at dirpath so
+// that its listing begins with "." and "..". Either entry is omitted if it
+// cannot be stat'd.
+func (s *server) withDotEntries(d DirReader, dirpath string) DirReader {
+	dots := make([]os.FileInfo, 0, 2)
+	if info, err := s.Stat(dirpath); err == nil {
+		dots = append(dots, namedFileInfo{info, "."})
+	}
+	if info, err := s.Stat(path.Join(dirpath, "..")); err == nil {
+		dots = append(dots, namedFileInfo{info, ".."})
+	}
+	return &dotDirReader{d, dots}
+}
+
+func (d *dotDirReader) ReadEntries(dst []os.FileInfo) (int, error) {
+	n := copy(dst, d.dots)
+	d.dots = d.dots[n:]
+	if n == len(dst) {
+		return n, nil
+	}
+	copied, err := d.DirReader.ReadEntries(dst[n:])
+	return n + copied, err
+}
+
+// Close closes the wrapped DirReader if it is an io.Closer.
+func (d *dotDirReader) Close() error {
+	if closer, ok := d.DirReader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// dirSizeReader wraps a DirReader for the directory at dirpath, applying
+// ServerOpts.DirSize to the entries which are directories.
+type dirSizeReader struct {
+	DirReader
+	dirpath string
+	dirSize func(path string, info os.FileInfo) int64
+}
+
+func (d *dirSizeReader) ReadEntries(dst []os.FileInfo) (int, error) {
+	n, err := d.DirReader.ReadEntries(dst)
+	for i, fi := range dst[:n] {
+		if fi.IsDir() {
+			dst[i] = sizedFileInfo{fi, d.dirSize(path.Join(d.dirpath, entryName(fi)), fi)}
+		}
+	}
+	return n, err
+}
+
+// Close closes the wrapped DirReader if it is an io.Closer.
+func (d *dirSizeReader) Close() error {
+	if closer, ok := d.DirReader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// syncDirReader serializes access to a DirReader, so that even concurrent
+// requests on the same directory handle cannot race, e.g. within
+// os.File.Readdir. Entries which were read but could not be sent are kept to
+// be read again first.
+type syncDirReader struct {
+	DirReader
+	unread []os.FileInfo
+	mtx    sync.Mutex
+}
+
+func (d *syncDirReader) ReadEntries(dst []os.FileInfo) (int, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	n := copy(dst, d.unread)
+	d.unread = d.unread[n:]
+	if n == len(dst) {
+		return n, nil
+	}
+	copied, err := d.DirReader.ReadEntries(dst[n:])
+	return n + copied, err
+}
+
+// unreadEntries returns entries to be read again before any others.
+func (d *syncDirReader) unreadEntries(entries []os.FileInfo) {
+	if len(entries) == 0 {
+		return
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.unread = append(append([]os.FileInfo(nil), entries...), d.unread...)
+}
+
+// Close closes the wrapped DirReader if it is an io.Closer.
+func (d *syncDirReader) Close() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if closer, ok := d.DirReader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// sliceDirReader is a DirReader over a fixed list of entries.
+type sliceDirReader struct {
+	entries []os.FileInfo
+}
+
+func (d *sliceDirReader) ReadEntries(dst []os.FileInfo) (int, error) {
+	n := copy(dst, d.entries)
+	d.entries = d.entries[n:]
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
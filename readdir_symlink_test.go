@@ -0,0 +1,70 @@
+package sftp_test
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/tera-insights/sftp"
+)
+
+// TestReaddirSymlinks checks that symbolic links are listed as links, without
+// following them, whether they lead to a file, a directory or nowhere.
+func TestReaddirSymlinks(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		newHandler func(t *testing.T) (sftp.RequestHandler, string)
+	}{
+		{"MemFS", func(t *testing.T) (sftp.RequestHandler, string) {
+			return sftp.MemFS(), "/"
+		}},
+		{"HostFS", func(t *testing.T) (sftp.RequestHandler, string) {
+			return sftp.HostFS(sftp.HostFSOpts{AllowWrite: true}), filepath.ToSlash(t.TempDir())
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, root := tc.newHandler(t)
+			f, err := h.OpenFile(path.Join(root, "file"), os.O_WRONLY|os.O_CREATE, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			if err := h.Mkdir(path.Join(root, "dir"), &sftp.FileAttr{}); err != nil {
+				t.Fatal(err)
+			}
+			links := map[string]string{
+				"to-file":    path.Join(root, "file"),
+				"to-dir":     path.Join(root, "dir"),
+				"to-nothing": path.Join(root, "missing"),
+			}
+			for link, target := range links {
+				if err := h.Symlink(path.Join(root, link), target); err != nil {
+					t.Fatalf("Symlink(%s): %v", link, err)
+				}
+			}
+
+			c := serve(t, h, sftp.ServerOpts{})
+			handle := opendir(t, c, root)
+			listed := 0
+			for entries := readdir(t, c, handle); entries != nil; entries = readdir(t, c, handle) {
+				for _, e := range entries {
+					if _, isLink := links[e.name]; isLink {
+						listed++
+						if e.flags&uint32(sftp.AttrFlagPermissions) == 0 || e.mode&0170000 != 0120000 {
+							t.Errorf("%s listed with mode %#o, want a symbolic link", e.name, e.mode)
+						}
+						// Long names are only in ls -l format where the
+						// platform's stat information is available
+						if e.longName != e.name && e.longName[0] != 'l' {
+							t.Errorf("%s listed with long name %q, want a symbolic link", e.name, e.longName)
+						}
+					}
+				}
+			}
+			if listed != len(links) {
+				t.Fatalf("listed %d symbolic links, want %d", listed, len(links))
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package sftp_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/tera-insights/sftp"
+	"github.com/tera-insights/sftp/sftptest"
+)
+
+// synthDir is a DirReader listing a directory of the given number of files,
+// which are generated as they are read rather than held in memory.
+type synthDir struct {
+	n, next  int
+	maxBatch int // largest number of entries requested at once
+}
+
+func (d *synthDir) ReadEntries(dst []os.FileInfo) (int, error) {
+	if len(dst) > d.maxBatch {
+		d.maxBatch = len(dst)
+	}
+	i := 0
+	for ; i < len(dst) && d.next < d.n; i++ {
+		dst[i] = synthFile(d.next)
+		d.next++
+	}
+	if d.next == d.n {
+		return i, io.EOF
+	}
+	return i, nil
+}
+
+// synthFile is the os.FileInfo of the file of a synthDir at an index.
+type synthFile int
+
+func (f synthFile) Name() string       { return synthName(int(f)) }
+func (f synthFile) Size() int64        { return int64(f) }
+func (f synthFile) Mode() os.FileMode  { return 0644 }
+func (f synthFile) ModTime() time.Time { return time.Unix(1e9, 0) }
+func (f synthFile) IsDir() bool        { return false }
+func (f synthFile) Sys() interface{}   { return nil }
+
+func synthName(i int) string {
+	return fmt.Sprintf("file%08d", i)
+}
+
+// synthFS serves a synthDir at /big, and MemFS otherwise.
+type synthFS struct {
+	sftp.RequestHandler
+	dir *synthDir
+}
+
+func (fs synthFS) OpenDir(name string) (sftp.DirReader, error) {
+	if name == "/big" {
+		return fs.dir, nil
+	}
+	return fs.RequestHandler.OpenDir(name)
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// TestReaddirLarge lists a directory far larger than a single SSH_FXP_READDIR
+// reply, checking that every entry is sent exactly once and in order, in
+// batches of at most MaxReaddirItems, and that the server's memory use does
+// not grow with the number of entries listed so far.
+func TestReaddirLarge(t *testing.T) {
+	n := 200000
+	if testing.Short() {
+		n = 20000
+	}
+	dir := &synthDir{n: n}
+	c := serve(t, synthFS{sftp.MemFS(), dir}, sftp.ServerOpts{})
+	handle := opendir(t, c, "/big")
+
+	start := heapInUse()
+	var peak uint64
+	next, batches := 0, 0
+	for entries := readdir(t, c, handle); entries != nil; entries = readdir(t, c, handle) {
+		if len(entries) > sftp.MaxReaddirItems {
+			t.Fatalf("received %d entries at once, want at most %d", len(entries), sftp.MaxReaddirItems)
+		}
+		for _, e := range entries {
+			if want := synthName(next); e.name != want {
+				t.Fatalf("received entry %q, want %q", e.name, want)
+			}
+			next++
+		}
+		if batches++; batches%(n/sftp.MaxReaddirItems/10) == 0 {
+			if heap := heapInUse(); heap > peak {
+				peak = heap
+			}
+		}
+	}
+	if next != n {
+		t.Fatalf("listed %d entries, want %d", next, n)
+	}
+	if dir.maxBatch > sftp.MaxReaddirItems {
+		t.Fatalf("server read %d entries at once, want at most %d", dir.maxBatch, sftp.MaxReaddirItems)
+	}
+	if peak > start && peak-start > 4<<20 {
+		t.Fatalf("heap grew by %d bytes while listing %d entries", peak-start, n)
+	}
+}
+
+// BenchmarkReaddirLarge lists a large synthetic directory, reporting the
+// memory allocated per listing, which should grow no faster than the number of
+// entries.
+func BenchmarkReaddirLarge(b *testing.B) {
+	const n = 100000
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c, done := sftptest.ServePipe(synthFS{sftp.MemFS(), &synthDir{n: n}}, sftp.ServerOpts{})
+		if _, _, err := c.Init(); err != nil {
+			b.Fatal(err)
+		}
+		handle := opendir(b, c, "/big")
+		listed := 0
+		for entries := readdir(b, c, handle); entries != nil; entries = readdir(b, c, handle) {
+			listed += len(entries)
+		}
+		if listed != n {
+			b.Fatalf("listed %d entries, want %d", listed, n)
+		}
+		c.Close()
+		<-done
+	}
+}
@@ -6,23 +6,58 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
 )
 
 // maxReadWriteSize is the maximum number of bytes which may be transferred in
 // a single SSH_FXP_READ or SSH_FXP_WRITE packet.
 const maxReadWriteSize = 1 << 15
 
-// MaxReaddirItems is the maximum number of files to return for a single
-// SSH_FXP_READDIR request.
+// maxPacketLength is the maximum length of an incoming packet. It leaves ample
+// room for an SSH_FXP_WRITE of maxReadWriteSize bytes, and matches the limit
+// used by OpenSSH.
+const maxPacketLength = 256 * 1024
+
+// MaxReaddirItems is the default maximum number of files to return for a
+// single SSH_FXP_READDIR request; see ServerOpts.MaxReaddirItems.
 const MaxReaddirItems = 100
 
-var errNoSuchHandle = errors.New("invalid handle")
+// ErrTruncatedPacket is returned by Serve if the transport reaches EOF partway
+// through a packet, e.g. because the client was killed mid-request, whereas
+// reaching EOF between packets, i.e. the client ending the session normally,
+// returns io.EOF.
+var ErrTruncatedPacket = errors.New("sftp: transport closed partway through a packet")
+
+var (
+	errNotInitialized = errors.New("sftp: packet received before SSH_FXP_INIT")
+	errDuplicateInit  = errors.New("sftp: duplicate SSH_FXP_INIT")
 
-// A FileHandle is an TODO(samterainsights)
+	errNoSuchHandle = fxerr(fxInvalidHandle).WithMessage("no such handle")
+	errHandleIsDir  = fxerr(fxInvalidHandle).WithMessage("handle refers to a directory, not a file")
+	errHandleIsFile = fxerr(fxInvalidHandle).WithMessage("handle refers to a file, not a directory")
+)
+
+// A FileHandle is a file opened by RequestHandler.OpenFile. Its os.FileInfo
+// methods describe the file, and are used to answer SSH_FXP_FSTAT unless it
+// implements FileStatter.
+//
+// Clients resume an interrupted upload by reopening the file without
+// truncating it, retrieving its current size via SSH_FXP_STAT or
+// SSH_FXP_FSTAT, then writing onwards from that offset; or by opening it with
+// PFlagAppend, in which case the offsets of writes are ignored and data is
+// appended. Either way, the reported size must account for all data written so
+// far, including through other handles.
+//
+// If a FileHandle buffers writes, it should also implement Flusher or Syncer.
+// Before a handle is closed in response to SSH_FXP_CLOSE, its Flush/Sync method
+// is called and any error is reported to the client as a failure, so the client
+// knows its data may not have persisted.
 type FileHandle interface {
 	os.FileInfo
 	io.ReaderAt
@@ -32,6 +67,49 @@ type FileHandle interface {
 	Setstat(*FileAttr) error
 }
 
+// FileStatter is implemented by FileHandles whose embedded os.FileInfo is a
+// snapshot which may go stale, e.g. after writes. If implemented, Stat is used
+// to answer SSH_FXP_FSTAT instead of the embedded os.FileInfo.
+type FileStatter interface {
+	Stat() (os.FileInfo, error)
+}
+
+// Preallocator is implemented by FileHandles which can reserve storage ahead of
+// writes. When a client creates or truncates a file for writing and specifies
+// its size, the size is passed to Preallocate as a hint, e.g. to avoid
+// fragmentation, if ServerOpts.MaxPreallocate permits. Preallocate must not
+// change the reported size of the file. Errors are ignored, since the hint is
+// optional.
+type Preallocator interface {
+	Preallocate(size int64) error
+}
+
+// ContextReaderAt may optionally be implemented by FileHandles which can make
+// use of a context, e.g. those backed by network storage. If implemented,
+// ReadAtContext is called instead of ReadAt, with a context which is canceled
+// once the client has ended the session and every request it sent has been
+// handed to the handler, so that a read still blocked then can be abandoned.
+type ContextReaderAt interface {
+	ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error)
+}
+
+// ContextWriterAt is the counterpart of ContextReaderAt for writes. If
+// implemented, WriteAtContext is called instead of WriteAt.
+type ContextWriterAt interface {
+	WriteAtContext(ctx context.Context, p []byte, off int64) (n int, err error)
+}
+
+// Flusher is implemented by FileHandles which buffer writes in memory.
+type Flusher interface {
+	Flush() error
+}
+
+// Syncer is implemented by FileHandles which can commit written data to stable
+// storage, e.g. *os.File.
+type Syncer interface {
+	Sync() error
+}
+
 // DirReader is the interface that wraps the basic ReadEntries method.
 //
 // ReadEntries reads the contents of the associated directory, returning
@@ -42,16 +120,23 @@ type FileHandle interface {
 // returning the number of entries copied and a non-nil error if
 // copied < len(dst). Should return io.EOF if there are simply no more
 // entries left.
+//
+// The server never calls ReadEntries or Close concurrently on the same
+// DirReader, so implementations need not be safe for concurrent use.
 type DirReader interface {
 	ReadEntries(dst []os.FileInfo) (copied int, err error)
 }
 
 // RequestHandler is responsible for handling the various kinds of SFTP requests.
-// Two implementations are provided by this library: an in-memory filesystem and
-// a wrapper around the OS filesystem. All paths are cleaned before being passed
-// to a RequestHandler.
+// Several implementations are provided by this library: an in-memory filesystem,
+// a read-only snapshot of in-memory files, an adapter for any fs.FS, and a
+// wrapper around the OS filesystem. All paths are cleaned before being passed
+// to a RequestHandler. If ServerOpts.WorkDir is set, relative paths are also
+// resolved against it, so the handler only ever sees absolute paths.
 type RequestHandler interface {
-	// OpenFile should behave identically to os.OpenFile.
+	// OpenFile should behave identically to os.OpenFile, except that opening a
+	// directory should fail with ErrIsADirectory; clients must use
+	// SSH_FXP_OPENDIR to open directories.
 	OpenFile(string, int, os.FileMode) (FileHandle, error)
 
 	// Mkdir creates a new directory. An error should be returned if the specified
@@ -65,10 +150,12 @@ type RequestHandler interface {
 	OpenDir(string) (DirReader, error)
 
 	// Rename renames the given path. An error should be returned if the path does
-	// not exist or the new path already exists.
+	// not exist or the new path already exists, preferably ErrFileAlreadyExists.
 	Rename(path, to string) error
 
-	// Stat retrieves info about the given path, following symlinks.
+	// Stat retrieves info about the given path, following symlinks. Statting
+	// a dangling symlink should fail as though the path does not exist, since
+	// its target does not; use Lstat to retrieve info about the link itself.
 	Stat(string) (os.FileInfo, error)
 
 	// Lstat retrieves info about the given path, and does not follow symlinks,
@@ -96,35 +183,430 @@ type RequestHandler interface {
 	RealPath(string) (string, error)
 }
 
+// SessionFactory may optionally be implemented by a RequestHandler to give each
+// session its own isolated handler, e.g. a scratch filesystem. If implemented,
+// NewSession is called once at the start of every session and the returned
+// handler serves that session in its place; it may itself implement
+// SessionHandler. Handlers which do not implement SessionFactory are shared by
+// all sessions they serve.
+type SessionFactory interface {
+	NewSession() RequestHandler
+}
+
+// SessionHandler may optionally be implemented by a RequestHandler which needs
+// to perform connection-scoped setup and teardown.
+//
+// SessionStart is called before any packets are read from the client; if it
+// returns an error, the session is aborted and SessionEnd is not called. The
+// given context is canceled when the session ends. Otherwise, SessionEnd is
+// called exactly once after the session ends and all handles are closed, with
+// the error which ended it. The context also carries the session's
+// SessionInfo.
+type SessionHandler interface {
+	SessionStart(ctx context.Context) error
+	SessionEnd(err error)
+}
+
+// SessionInfo describes the client of a session, as far as the server knows.
+type SessionInfo struct {
+	// ClientVersion is ServerOpts.ClientVersion.
+	ClientVersion string
+}
+
+type sessionInfoKey struct{}
+
+// SessionInfoFromContext returns the SessionInfo carried by the context passed
+// to SessionHandler.SessionStart, or false if there is none.
+func SessionInfoFromContext(ctx context.Context) (SessionInfo, bool) {
+	info, ok := ctx.Value(sessionInfoKey{}).(SessionInfo)
+	return info, ok
+}
+
+// PosixRenamer may optionally be implemented by a RequestHandler to support the
+// "posix-rename@openssh.com" extension. PosixRename differs from Rename in that
+// it atomically replaces the new path if it already exists, as rename(2) does.
+type PosixRenamer interface {
+	PosixRename(path, to string) error
+}
+
+// StatVFSer may optionally be implemented by a RequestHandler to support the
+// "statvfs@openssh.com" extension.
+type StatVFSer interface {
+	StatVFS(string) (*StatVFS, error)
+}
+
+// SymlinkOrder is the order in which SSH_FXP_SYMLINK requests are decoded as
+// sending their paths. OpenSSH reversed the order given by the spec, and many
+// clients followed suit.
+type SymlinkOrder int
+
+const (
+	// SymlinkOrderAuto uses the spec's order if ServerOpts.ClientVersion
+	// identifies a client other than OpenSSH, and otherwise OpenSSH's.
+	SymlinkOrderAuto SymlinkOrder = iota
+
+	// SymlinkOrderOpenSSH expects the target path, then the link path.
+	SymlinkOrderOpenSSH
+
+	// SymlinkOrderSpec expects the link path, then the target path.
+	SymlinkOrderSpec
+)
+
+// ReaddirAttrs selects which attributes are sent for each entry in replies to
+// SSH_FXP_READDIR.
+type ReaddirAttrs int
+
+const (
+	// ReaddirAttrsFull sends all the attributes known for each entry.
+	ReaddirAttrsFull ReaddirAttrs = iota
+
+	// ReaddirAttrsSizeMode sends only the size and permissions of each entry.
+	ReaddirAttrsSizeMode
+
+	// ReaddirAttrsNone sends no attributes, only names and long names.
+	ReaddirAttrsNone
+)
+
+// ServerOpts is used to configure an SFTP server.
+type ServerOpts struct {
+	// WorkDir is the absolute path of the session's working directory. There
+	// is no "cd" in SFTP; clients such as the OpenSSH CLI instead call
+	// SSH_FXP_REALPATH on "." at startup and derive absolute paths from the
+	// reply. If WorkDir is set, that reply is WorkDir and any relative paths
+	// the client sends are joined against it. Otherwise relative paths are
+	// passed to the RequestHandler as-is, and RealPath is left to the handler.
+	//
+	// WorkDir is also reported as the user's home directory via the
+	// "home-directory" extension, which is only advertised if WorkDir is set.
+	WorkDir string
+
+	// ClientVersion is the version banner the client sent when the underlying
+	// connection was established, e.g. ssh.ConnMetadata.ClientVersion, which
+	// the server does not otherwise know. It is made available to handlers
+	// via SessionInfo, e.g. to work around quirks of particular clients.
+	ClientVersion string
+
+	// SymlinkOrder is the order in which SSH_FXP_SYMLINK requests send their
+	// paths, by default chosen from ClientVersion.
+	SymlinkOrder SymlinkOrder
+
+	// LongNameFormatter, if set, produces the "long name" sent alongside each
+	// file name in SSH_FXP_NAME replies to SSH_FXP_READDIR and SSH_FXP_REALPATH.
+	// The spec does not define a format but recommends the output of `ls -l`,
+	// which is what the default produces; override it to match what a
+	// particular client expects to parse.
+	LongNameFormatter func(os.FileInfo) string
+
+	// UserName and GroupName resolve user and group IDs to names for the
+	// "users-groups-by-id@openssh.com" extension, returning an empty string
+	// for unknown IDs. If either is nil, the corresponding names are all
+	// reported as unknown.
+	UserName  func(uid uint32) string
+	GroupName func(gid uint32) string
+
+	// IncludeDotEntries causes directory listings to begin with synthesized
+	// "." and ".." entries, which some clients expect. Their attributes are
+	// those of the directory and its parent respectively.
+	IncludeDotEntries bool
+
+	// MaxReaddirItems is the maximum number of entries sent in reply to each
+	// SSH_FXP_READDIR, defaulting to the MaxReaddirItems constant. Raising it
+	// lets clients list large directories in fewer round trips. Regardless,
+	// each reply only holds as many entries as fit in the largest packet
+	// OpenSSH accepts, and the rest are sent in reply to the next request.
+	MaxReaddirItems int
+
+	// MaxPreallocate is the largest size hint passed to a Preallocator, to
+	// which larger hints are clamped. Since preallocated space is reserved
+	// without the file growing, a client could otherwise claim the whole disk
+	// without writing anything. Zero, the default, disables preallocation.
+	MaxPreallocate int64
+
+	// ReaddirAttrs limits the attributes sent for each entry in replies to
+	// SSH_FXP_READDIR, which shrinks large listings for clients needing little
+	// more than names. The long name still describes each entry in full.
+	ReaddirAttrs ReaddirAttrs
+
+	// FairScheduling makes reads and writes on different handles take turns,
+	// rather than being served strictly in the order they arrive, so that a
+	// transfer with many requests outstanding cannot starve concurrent ones.
+	// Their replies may then overtake those to requests on other handles,
+	// which the protocol permits, but which a few old clients mishandle.
+	FairScheduling bool
+
+	// ReportInodes adds a stable identifier of the file, such as its inode
+	// number, to replies to stat requests via InodeExtension, for clients
+	// which detect renames or cache by file. Handlers which cannot identify
+	// their files, e.g. FSHandler, report none.
+	ReportInodes bool
+
+	// VendorID identifies the server to clients which send a "vendor-id"
+	// extended request, and in SSH_FXP_VERSION. If unset, this library is
+	// reported, with the version it was built at.
+	VendorID VendorID
+
+	// DisabledOps lists types of request which are refused with
+	// ErrOpUnsupported, by the names of their packet types, e.g.
+	// "SSH_FXP_RENAME" or "SSH_FXP_SYMLINK", for finer control than a
+	// read-only handler gives. Extended requests which are variants of a
+	// disabled request, e.g. "posix-rename@openssh.com", are disabled too, and
+	// "SSH_FXP_EXTENDED" disables all extended requests. Serve fails if any
+	// name is not that of a request.
+	DisabledOps []string
+
+	// DirSize, if set, computes the size reported for directories in reply to
+	// SSH_FXP_STAT, SSH_FXP_LSTAT and SSH_FXP_READDIR, given the directory's
+	// resolved path and info, e.g. its number of entries or a fixed block
+	// size. Otherwise the size reported by the handler is used.
+	DirSize func(path string, info os.FileInfo) int64
+
+	// AttrRewriter, if set, may rewrite the attributes sent in reply to
+	// SSH_FXP_STAT, SSH_FXP_LSTAT, SSH_FXP_FSTAT and SSH_FXP_READDIR, e.g. to
+	// mask the real owners of files, given the resolved path they describe
+	// (for SSH_FXP_FSTAT, the path the file was opened with). attr is the
+	// server's own copy, which may be modified in place; if the attributes
+	// returned are not nil, they are sent instead. Long names are produced
+	// from the handler's os.FileInfo regardless, so LongNameFormatter may need
+	// overriding too.
+	AttrRewriter func(path string, attr *FileAttr) *FileAttr
+
+	// NormalizeUnicode causes all incoming paths and outgoing directory entry
+	// names to be normalized to UnicodeForm (NFC by default). Clients on
+	// macOS tend to send NFD-normalized names while Linux uses NFC, so
+	// without normalization the "same" name may not resolve to the same file.
+	NormalizeUnicode bool
+	UnicodeForm      norm.Form
+
+	// DefaultFileMode and DefaultDirMode are the permissions used to create
+	// files and directories respectively when the client does not specify
+	// any. They default to 0644 and 0755.
+	DefaultFileMode os.FileMode
+	DefaultDirMode  os.FileMode
+
+	// PreserveAtime causes SSH_FXP_SETSTAT and SSH_FXP_FSETSTAT to leave the
+	// access time of a file as-is when setting its modification time. SFTP v3
+	// can only set both at once, so clients wanting to set the mtime alone
+	// must send some atime, which is ignored with this option enabled.
+	PreserveAtime bool
+
+	// Umask is cleared from the permission bits of files and directories
+	// created by the server, whether those came from the client or from
+	// DefaultFileMode/DefaultDirMode.
+	Umask os.FileMode
+
+	// MaxOpenHandles, if positive, limits the number of file and directory
+	// handles a client may have open at once. Further SSH_FXP_OPEN and
+	// SSH_FXP_OPENDIR requests fail until some handles are closed.
+	MaxOpenHandles int
+
+	// OnReadClamped, if set, is called whenever a client requests more than
+	// the maximum of 32KiB in a single SSH_FXP_READ, with the length it
+	// requested. The reply is clamped to the maximum; tracking how often this
+	// happens shows whether clients would benefit from a larger limit. It may
+	// be called concurrently.
+	OnReadClamped func(requested uint32)
+
+	// Logger, if set, receives diagnostic messages such as slow operations.
+	Logger Logger
+
+	// SlowOpThreshold, if positive, causes any request which takes longer to
+	// handle to be logged to Logger along with its duration.
+	SlowOpThreshold time.Duration
+
+	// AllowedExtensions, if non-nil, lists the only SSH_FXP_EXTENDED requests
+	// the server accepts, by name, e.g. "posix-rename@openssh.com". Others are
+	// refused with ErrOpUnsupported before their data is even decoded, and are
+	// not advertised in SSH_FXP_VERSION. An empty, non-nil slice refuses all
+	// extended requests.
+	AllowedExtensions []string
+
+	// OnSessionEnd, if set, is called once the session has ended and all of
+	// its handles have been closed, with statistics about the session.
+	OnSessionEnd func(stats SessionStats)
+
+	// MaxNameLen is the maximum length in bytes of each component of a path
+	// which SSH_FXP_OPEN, SSH_FXP_MKDIR, SSH_FXP_RENAME, SSH_FXP_SYMLINK or
+	// posix-rename may create. Longer names are refused with
+	// ErrInvalidFilename before reaching the handler. It defaults to 255, the
+	// limit of most filesystems; a negative value disables the check.
+	MaxNameLen int
+
+	// DisallowedNameChars lists characters which may not appear in any path
+	// sent by the client, e.g. control characters or those a backend cannot
+	// store. Such paths are refused with ErrInvalidFilename before reaching
+	// the handler. Paths containing NUL bytes are always refused.
+	DisallowedNameChars string
+}
+
+// SessionStats describes a session which has ended.
+type SessionStats struct {
+	// HandlesClosed is the number of handles the client closed itself.
+	HandlesClosed int
+
+	// HandlesForceClosed is the number of handles the client left open, which
+	// the server closed when the session ended. Many clients don't bother
+	// closing handles before disconnecting, but a high count relative to
+	// HandlesClosed may indicate a client which leaks them.
+	HandlesForceClosed int
+}
+
 // server abstracts the sftp protocol with an http request-like protocol
 type server struct {
 	io.ReadWriter
 	RequestHandler
+	ServerOpts
 
+	caps         Capabilities
+	allowedExts  map[string]bool // nil if all extensions are allowed
+	disabledOps  map[fxp]bool
 	pktMgr       *packetManager
 	openFiles    map[string]FileHandle
 	openFilesMtx sync.RWMutex
-	openDirs     map[string]DirReader
+	openDirs     map[string]*syncDirReader
 	openDirsMtx  sync.RWMutex
 	handleCtr    uint64
+
+	// The resolved path each open handle was opened with
+	handlePaths    map[string]string
+	handlePathsMtx sync.Mutex
+
+	// Counted for SessionStats
+	handlesClosed      uint64
+	handlesForceClosed uint64
 }
 
 // Serve the SFTP protocol over a connection. Generally you will want to serve it on top
 // of an SSH "session" channel, however it could also be served over TLS, etc. Note that
 // SFTP has no security provisions so it should always be layered on top of a secure
-// connection.
+// connection. Buffered transports, e.g. a *bufio.ReadWriter, are supported: if the
+// transport implements Flusher, it is flushed whenever responses have been written.
+//
+// Serve returns io.EOF once the client closes the connection between requests,
+// or ErrTruncatedPacket if it does so partway through one.
 func Serve(transport io.ReadWriter, handler RequestHandler) error {
+	return ServeWithOpts(transport, handler, ServerOpts{})
+}
+
+// ServeAndClose is identical to Serve, but closes the transport once serving
+// finishes, whether or not an error occurred. All open handles are closed
+// before the transport. If serving succeeded, any error from closing the
+// transport is returned.
+func ServeAndClose(transport io.ReadWriteCloser, handler RequestHandler) error {
+	err := Serve(transport, handler)
+	if cerr := transport.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ServeWithOpts is identical to Serve but allows configuring the server.
+func ServeWithOpts(transport io.ReadWriter, handler RequestHandler, opts ServerOpts) error {
+	return NewServer(transport, handler, opts).Serve()
+}
+
+// ErrServerClosed is returned by Server.Serve once Server.Close is called.
+var ErrServerClosed = errors.New("sftp: server closed")
+
+// A Server serves the SFTP protocol over a single connection, as Serve does,
+// but can also be shut down while serving.
+type Server struct {
+	transport io.ReadWriter
+	handler   RequestHandler
+	opts      ServerOpts
+
+	closing chan struct{} // closed by Close
+	served  chan struct{} // closed once Serve returns
+	started bool
+	closed  bool
+	mtx     sync.Mutex
+}
+
+// NewServer creates a Server for the given transport, which does nothing until
+// Serve is called.
+func NewServer(transport io.ReadWriter, handler RequestHandler, opts ServerOpts) *Server {
+	return &Server{
+		transport: transport,
+		handler:   handler,
+		opts:      opts,
+		closing:   make(chan struct{}),
+		served:    make(chan struct{}),
+	}
+}
+
+// Close shuts the server down gracefully: no further requests are accepted,
+// but those already received are completed and replied to before all handles
+// are closed and Serve returns ErrServerClosed. Close waits for Serve to
+// return. It does not close the transport, so a read from it which is in
+// progress continues in the background until the transport is closed.
+func (srv *Server) Close() error {
+	srv.mtx.Lock()
+	if !srv.closed {
+		srv.closed = true
+		close(srv.closing)
+	}
+	started := srv.started
+	srv.mtx.Unlock()
+
+	if started {
+		<-srv.served
+	}
+	return nil
+}
+
+// Serve serves the connection until the client ends the session, an error
+// occurs, or Close is called, and returns as Serve does. It may only be called
+// once.
+func (srv *Server) Serve() (err error) {
+	srv.mtx.Lock()
+	if srv.closed || srv.started {
+		srv.mtx.Unlock()
+		return ErrServerClosed
+	}
+	srv.started = true
+	srv.mtx.Unlock()
+	defer close(srv.served)
+
+	transport, handler, opts := srv.transport, srv.handler, srv.opts
+	disabledOps, err := parseOps(opts.DisabledOps)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), sessionInfoKey{}, SessionInfo{
+		ClientVersion: opts.ClientVersion,
+	}))
+	defer cancel()
+
+	if factory, ok := handler.(SessionFactory); ok {
+		handler = factory.NewSession()
+	}
+
+	if sh, ok := handler.(SessionHandler); ok {
+		if err = sh.SessionStart(ctx); err != nil {
+			return errors.Wrap(err, "error starting session")
+		}
+		defer func() { sh.SessionEnd(err) }()
+	}
+
 	s := &server{
 		ReadWriter:     transport,
 		RequestHandler: handler,
-		pktMgr:         newPktMgr(transport),
+		ServerOpts:     opts,
+		caps:           handlerCapabilities(handler),
+		allowedExts:    stringSet(opts.AllowedExtensions),
+		disabledOps:    disabledOps,
+		pktMgr:         newPktMgr(transport, opts.FairScheduling),
 		openFiles:      make(map[string]FileHandle),
-		openDirs:       make(map[string]DirReader),
+		openDirs:       make(map[string]*syncDirReader),
+		handlePaths:    make(map[string]string),
 	}
-	defer s.closeAllHandles()
+	defer s.endSession()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Reads and writes get a context of their own, so that those blocked in
+	// the handler can be abandoned while the session's context, which e.g.
+	// AtomicUploads consults as handles are closed, stays live until every
+	// request has been served
+	ioCtx, cancelIO := context.WithCancel(ctx)
+	defer cancelIO()
 
 	var wg sync.WaitGroup
 
@@ -132,34 +614,73 @@ func Serve(transport io.ReadWriter, handler RequestHandler) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := s.packetWorker(ctx, ch); err != nil {
+			if err := s.packetWorker(ioCtx, ch); err != nil {
 				// FIXME(samterainsights): propagate error
 			}
 		}()
 	})
 
-	defer wg.Wait()
-	defer close(pktChan)
+	graceful := false
+	defer func() {
+		// Requests already received are still served, however the session
+		// ended, so that e.g. a WRITE followed by a CLOSE is not lost if the
+		// client disconnects without waiting for the replies. Unless closing
+		// gracefully, reads and writes which are still blocked once every
+		// request has been taken up are then abandoned.
+		close(pktChan)
+		if !graceful {
+			go func() {
+				s.pktMgr.waitTaken()
+				cancelIO()
+			}()
+		}
+		wg.Wait()
+		if graceful || err == io.EOF {
+			// The client may still be reading the replies
+			s.pktMgr.wait()
+		}
+		cancel()
+		s.closeAllHandles()
+	}()
 
-	for {
-		pktType, pktBytes, err := readPacket(transport)
-		if err != nil {
+	// Packets are read in the background so that Close need not wait for the
+	// client to send another
+	packets := make(chan rawPacket)
+	stopReading := make(chan struct{})
+	defer close(stopReading)
+	go readPackets(transport, packets, stopReading)
+
+	for initialized := false; ; initialized = true {
+		var raw rawPacket
+		select {
+		case raw = <-packets:
+		case <-srv.closing:
+			graceful = true
+			return ErrServerClosed
+		}
+		pktType, pktBytes, err := raw.typ, raw.data, raw.err
+		if err == io.EOF || err == ErrTruncatedPacket {
+			return err // unwrapped, so callers can compare against them
+		} else if err != nil {
 			return errors.Wrap(err, "error reading packet from transport")
 		}
 
-		pkt, err := makePacket(fxp(pktType), pktBytes)
-		if err != nil {
-			switch errors.Cause(err) {
-			case errUnknownExtendedPacket:
-				if err := s.replyError(pkt, ErrOpUnsupported); err != nil {
-					debug("failed to send err packet: %v", err)
-					// FIXME(samterainsights): propagate error
-					break
-				}
-			default:
-				debug("makePacket err: %v", err)
-				// FIXME(samterainsights): propagate error
-				break
+		// The protocol begins with exactly one SSH_FXP_INIT, and the client
+		// cannot recover from violating that, so end the session
+		if isInit := fxp(pktType) == fxpInit; isInit && initialized {
+			return errDuplicateInit
+		} else if !isInit && !initialized {
+			return errors.Wrapf(errNotInitialized, "received %v", fxp(pktType))
+		}
+
+		pkt, err := makePacket(fxp(pktType), pktBytes, s.extensionAllowed, s.symlinkFollowsSpec())
+		if err != nil && errors.Cause(err) != errUnknownExtendedPacket {
+			// Unknown extended packets fall through to packetWorker, which
+			// replies ErrOpUnsupported. Anything else which failed to decode
+			// must not reach the handler half-populated.
+			debug("makePacket err: %v", err)
+			if pkt, err = invalidRequest(fxp(pktType), pktBytes, err); err != nil {
+				return err
 			}
 		}
 
@@ -167,21 +688,64 @@ func Serve(transport io.ReadWriter, handler RequestHandler) error {
 	}
 }
 
+// rawPacket is a packet as returned by readPacket.
+type rawPacket struct {
+	typ  uint8
+	data []byte
+	err  error
+}
+
+// readPackets reads packets from the transport into the given channel until
+// reading fails or stop is closed.
+func readPackets(r io.Reader, packets chan<- rawPacket, stop <-chan struct{}) {
+	for {
+		typ, data, err := readPacket(r)
+		select {
+		case packets <- rawPacket{typ, data, err}:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 func (s *server) packetWorker(ctx context.Context, pktChan chan orderedRequest) error {
 	for pkt := range pktChan {
+		s.pktMgr.taken(pkt)
+		start := time.Now()
 		var rpkt responsePacket
+		if s.disabledOps[requestType(pkt.requestPacket)] {
+			s.pktMgr.readyPacket(orderedResponse{statusFromError(pkt, ErrOpUnsupported), pkt.orderID()})
+			continue
+		}
+		if err := s.checkNames(pkt.requestPacket); err != nil {
+			s.pktMgr.readyPacket(orderedResponse{statusFromError(pkt, err), pkt.orderID()})
+			continue
+		}
 		switch pkt := pkt.requestPacket.(type) {
 		case *fxpInitPkt:
-			rpkt = &fxpVersionPkt{Version: ProtocolVersion}
+			rpkt = &fxpVersionPkt{
+				Version:    ProtocolVersion,
+				Extensions: supportedExtensions(s),
+			}
 
 		case *fxpOpenPkt:
-			if f, err := s.OpenFile(path.Clean(pkt.Path), pkt.PFlags.os(), pkt.Attr.Perms); err != nil {
+			fpath := s.resolvePath(pkt.Path)
+			if err := s.checkHandleLimit(); err != nil {
+				rpkt = statusFromError(pkt, err)
+			} else if f, err := s.OpenFile(fpath, pkt.PFlags.os(), s.fileMode(pkt.Attr)); err != nil {
 				rpkt = statusFromError(pkt, err)
 			} else {
+				if size := s.preallocateSize(pkt); size > 0 {
+					preallocate(f, size)
+				}
 				handle := s.nextHandle()
 				s.openFilesMtx.Lock()
 				s.openFiles[handle] = f
 				s.openFilesMtx.Unlock()
+				s.setHandlePath(handle, fpath)
 				rpkt = &fxpHandlePkt{pkt.ID, handle}
 			}
 
@@ -190,14 +754,25 @@ func (s *server) packetWorker(ctx context.Context, pktChan chan orderedRequest)
 			if err == errNoSuchHandle {
 				err = s.closeDir(pkt.Handle)
 			}
+			if err != errNoSuchHandle {
+				// Even if closing failed, the handle is gone
+				atomic.AddUint64(&s.handlesClosed, 1)
+			}
 			rpkt = statusFromError(pkt, err)
 
 		case *fxpReadPkt:
 			if f, err := s.getFile(pkt.Handle); err != nil {
 				rpkt = statusFromError(pkt, err)
+			} else if pkt.Len == 0 {
+				// Handlers disagree on whether an empty read at or past the
+				// end of the file is EOF, so always reply with empty data
+				rpkt = &fxpDataPkt{pkt.ID, nil}
 			} else {
+				if pkt.Len > maxReadWriteSize {
+					s.readClamped(pkt.Len)
+				}
 				data := make([]byte, clamp(pkt.Len, maxReadWriteSize))
-				n, err := f.ReadAt(data, int64(pkt.Offset))
+				n, err := readAt(ctx, f, data, int64(pkt.Offset))
 
 				if err != nil && (err != io.EOF || n == 0) {
 					rpkt = statusFromError(pkt, err)
@@ -210,58 +785,82 @@ func (s *server) packetWorker(ctx context.Context, pktChan chan orderedRequest)
 			if f, err := s.getFile(pkt.Handle); err != nil {
 				rpkt = statusFromError(pkt, err)
 			} else {
-				_, err = f.WriteAt(pkt.Data, int64(pkt.Offset))
-				rpkt = statusFromError(pkt, err)
+				rpkt = statusFromError(pkt, writeFull(ctx, f, pkt.Data, int64(pkt.Offset)))
 			}
 
 		case *fxpStatPkt:
-			if info, err := s.Stat(path.Clean(pkt.Path)); err != nil {
+			fpath := s.resolvePath(pkt.Path)
+			if info, err := s.Stat(fpath); err != nil {
 				rpkt = statusFromError(pkt, err)
 			} else {
 				rpkt = &fxpAttrPkt{
 					pkt.ID,
-					fileAttrFromInfo(info),
+					s.statAttr(fpath, s.sizeDir(fpath, info)),
 				}
 			}
 
 		case *fxpLstatPkt:
-			if info, err := s.Lstat(path.Clean(pkt.Path)); err != nil {
+			fpath := s.resolvePath(pkt.Path)
+			if info, err := s.Lstat(fpath); err != nil {
 				rpkt = statusFromError(pkt, err)
 			} else {
 				rpkt = &fxpAttrPkt{
 					pkt.ID,
-					fileAttrFromInfo(info),
+					s.statAttr(fpath, s.sizeDir(fpath, info)),
 				}
 			}
 
 		case *fxpFstatPkt:
 			if f, err := s.getFile(pkt.Handle); err != nil {
 				rpkt = statusFromError(pkt, err)
+			} else if info, err := statFile(f); err != nil {
+				rpkt = statusFromError(pkt, err)
 			} else {
 				rpkt = &fxpAttrPkt{
 					pkt.ID,
-					fileAttrFromInfo(f),
+					s.statAttr(s.handlePath(pkt.Handle), info),
 				}
 			}
 
 		case *fxpSetstatPkt:
-			rpkt = statusFromError(pkt, s.Setstat(path.Clean(pkt.Path), pkt.Attr))
+			fpath := s.resolvePath(pkt.Path)
+			if s.PreserveAtime && pkt.Attr.Flags&AttrFlagAcModTime != 0 {
+				if info, err := s.Stat(fpath); err == nil {
+					pkt.Attr.AcTime = exactFileAttrFromInfo(info).AcTime
+				}
+			}
+			rpkt = statusFromError(pkt, s.Setstat(fpath, pkt.Attr))
 
 		case *fxpFsetstatPkt:
 			if f, err := s.getFile(pkt.Handle); err != nil {
 				rpkt = statusFromError(pkt, err)
 			} else {
+				if s.PreserveAtime && pkt.Attr.Flags&AttrFlagAcModTime != 0 {
+					if info, err := statFile(f); err == nil {
+						pkt.Attr.AcTime = exactFileAttrFromInfo(info).AcTime
+					}
+				}
 				rpkt = statusFromError(pkt, f.Setstat(pkt.Attr))
 			}
 
 		case *fxpOpendirPkt:
-			if d, err := s.OpenDir(path.Clean(pkt.Path)); err != nil {
+			dirpath := s.resolvePath(pkt.Path)
+			if err := s.checkHandleLimit(); err != nil {
+				rpkt = statusFromError(pkt, err)
+			} else if d, err := s.OpenDir(dirpath); err != nil {
 				rpkt = statusFromError(pkt, err)
 			} else {
+				if s.IncludeDotEntries {
+					d = s.withDotEntries(d, dirpath)
+				}
+				if s.DirSize != nil {
+					d = &dirSizeReader{d, dirpath, s.DirSize}
+				}
 				handle := s.nextHandle()
 				s.openDirsMtx.Lock()
-				s.openDirs[handle] = d
+				s.openDirs[handle] = &syncDirReader{DirReader: d}
 				s.openDirsMtx.Unlock()
+				s.setHandlePath(handle, dirpath)
 				rpkt = &fxpHandlePkt{pkt.ID, handle}
 			}
 
@@ -269,57 +868,49 @@ func (s *server) packetWorker(ctx context.Context, pktChan chan orderedRequest)
 			if d, err := s.getDir(pkt.Handle); err != nil {
 				rpkt = statusFromError(pkt, err)
 			} else {
-				files := make([]os.FileInfo, MaxReaddirItems)
+				files := make([]os.FileInfo, s.readdirItems())
 				if n, err := d.ReadEntries(files); n > 0 {
-					items := make([]fxpNamePktItem, n)
-					for i, f := range files[:n] {
-						name := f.Name()
-						items[i].Name = name
-						items[i].LongName = name
-						items[i].Attr = fileAttrFromInfo(f)
-					}
-					rpkt = &fxpNamePkt{pkt.ID, items}
+					items := s.nameItems(s.handlePath(pkt.Handle), files[:n])
+					fit := fitNameItems(items)
+					d.unreadEntries(files[fit:n])
+					rpkt = &fxpNamePkt{pkt.ID, items[:fit]}
+				} else if err == nil {
+					// SSH_FX_OK is not a valid reply to SSH_FXP_READDIR, so treat
+					// a DirReader returning nothing without error as exhausted
+					rpkt = statusFromError(pkt, io.EOF)
 				} else {
 					rpkt = statusFromError(pkt, err)
 				}
 			}
 
 		case *fxpRemovePkt:
-			rpkt = statusFromError(pkt, s.Remove(path.Clean(pkt.Path)))
+			rpkt = statusFromError(pkt, s.Remove(s.resolvePath(pkt.Path)))
 
 		case *fxpMkdirPkt:
-			rpkt = statusFromError(pkt, s.Mkdir(path.Clean(pkt.Path), pkt.Attr))
+			rpkt = statusFromError(pkt, s.Mkdir(s.resolvePath(pkt.Path), s.dirAttr(pkt.Attr)))
 
 		case *fxpRmdirPkt:
-			rpkt = statusFromError(pkt, s.Rmdir(path.Clean(pkt.Path)))
+			rpkt = statusFromError(pkt, s.Rmdir(s.resolvePath(pkt.Path)))
 
 		case *fxpRealpathPkt:
-			if fpath := path.Clean(pkt.Path); path.IsAbs(fpath) {
-				rpkt = &fxpNamePkt{
-					ID: pkt.ID,
-					Items: []fxpNamePktItem{{
-						Name:     fpath,
-						LongName: fpath,
-						Attr:     &FileAttr{},
-					}},
-				}
+			if fpath := s.resolvePath(pkt.Path); path.IsAbs(fpath) {
+				rpkt = s.realpathReply(pkt.ID, fpath)
 			} else if abs, err := s.RealPath(fpath); err != nil {
 				rpkt = statusFromError(pkt, err)
 			} else {
-				rpkt = &fxpNamePkt{
-					pkt.ID,
-					[]fxpNamePktItem{{abs, abs, &FileAttr{}}},
-				}
+				rpkt = s.realpathReply(pkt.ID, abs)
 			}
 
 		case *fxpRenamePkt:
 			rpkt = statusFromError(pkt, s.Rename(
-				path.Clean(pkt.OldPath),
-				path.Clean(pkt.NewPath),
+				s.resolvePath(pkt.OldPath),
+				s.resolvePath(pkt.NewPath),
 			))
 
 		case *fxpReadlinkPkt:
-			if fpath, err := s.ReadLink(path.Clean(pkt.Path)); err != nil {
+			if !s.caps.Symlinks {
+				rpkt = statusFromError(pkt, ErrOpUnsupported)
+			} else if fpath, err := s.ReadLink(s.resolvePath(pkt.Path)); err != nil {
 				rpkt = statusFromError(pkt, err)
 			} else {
 				rpkt = &fxpNamePkt{
@@ -329,27 +920,261 @@ func (s *server) packetWorker(ctx context.Context, pktChan chan orderedRequest)
 			}
 
 		case *fxpSymlinkPkt:
-			rpkt = statusFromError(pkt, s.Symlink(
-				path.Clean(pkt.LinkPath),
-				path.Clean(pkt.TargetPath),
-			))
+			if !s.caps.Symlinks {
+				rpkt = statusFromError(pkt, ErrOpUnsupported)
+			} else {
+				rpkt = statusFromError(pkt, s.Symlink(
+					s.resolvePath(pkt.LinkPath),
+					path.Clean(s.normalize(pkt.TargetPath)),
+				))
+			}
+
+		case *fxpExtPosixRenamePkt:
+			if renamer, ok := s.RequestHandler.(PosixRenamer); !ok || !s.caps.PosixRename {
+				rpkt = statusFromError(pkt, ErrOpUnsupported)
+			} else {
+				rpkt = statusFromError(pkt, renamer.PosixRename(
+					s.resolvePath(pkt.OldPath),
+					s.resolvePath(pkt.NewPath),
+				))
+			}
+
+		case *fxpExtStatvfsPkt:
+			if statter, ok := s.RequestHandler.(StatVFSer); !ok || !s.caps.StatVFS {
+				rpkt = statusFromError(pkt, ErrOpUnsupported)
+			} else if vfs, err := statter.StatVFS(s.resolvePath(pkt.Path)); err != nil {
+				rpkt = statusFromError(pkt, err)
+			} else {
+				rpkt = &fxpExtVfsPkt{pkt.ID, *vfs}
+			}
+
+		case *fxpExtHomeDirectoryPkt:
+			if s.WorkDir == "" {
+				rpkt = statusFromError(pkt, ErrOpUnsupported)
+			} else if pkt.Username != "" {
+				rpkt = statusFromError(pkt, ErrOpUnsupported.WithMessage(
+					"home directories of other users are not available"))
+			} else {
+				rpkt = s.realpathReply(pkt.ID, s.WorkDir)
+			}
+
+		case *fxpExtUsersGroupsByIDPkt:
+			reply := &fxpExtUsersGroupsByIDReplyPkt{
+				ID:         pkt.ID,
+				Usernames:  make([]string, len(pkt.UIDs)),
+				Groupnames: make([]string, len(pkt.GIDs)),
+			}
+			if s.UserName != nil {
+				for i, uid := range pkt.UIDs {
+					reply.Usernames[i] = s.UserName(uid)
+				}
+			}
+			if s.GroupName != nil {
+				for i, gid := range pkt.GIDs {
+					reply.Groupnames[i] = s.GroupName(gid)
+				}
+			}
+			rpkt = reply
+
+		case *fxpExtVendorIDPkt:
+			rpkt = &fxpExtVendorIDReplyPkt{pkt.ID, s.vendorID()}
+
+		case *fxpExtCustomPkt:
+			if reply, err := pkt.handle(s.RequestHandler, pkt.Data); err != nil || reply == nil {
+				rpkt = statusFromError(pkt, err)
+			} else {
+				rpkt = &fxpExtendedReplyPkt{pkt.ID, reply}
+			}
+
+		case *invalidRequestPkt:
+			rpkt = statusFromError(pkt, pkt.err)
 
 		default:
 			rpkt = statusFromError(pkt, ErrOpUnsupported)
 		}
+		s.checkSlowOp(pkt.requestPacket, start)
 
 		s.pktMgr.readyPacket(orderedResponse{rpkt, pkt.orderID()})
 	}
 	return nil
 }
 
-func (s *server) replyError(pkt requestPacket, err error) error {
-	b, err := statusFromError(pkt, err).MarshalBinary()
-	if err != nil {
-		return err
+// sizeDir applies ServerOpts.DirSize to the info of the given path if it is a
+// directory.
+func (s *server) sizeDir(fpath string, info os.FileInfo) os.FileInfo {
+	if s.DirSize == nil || !info.IsDir() {
+		return info
+	}
+	return sizedFileInfo{info, s.DirSize(fpath, info)}
+}
+
+// fileMode returns the permissions with which to create a file opened with
+// the given attributes.
+func (s *server) fileMode(attr *FileAttr) os.FileMode {
+	mode := os.FileMode(0644)
+	if attr.Flags&AttrFlagPermissions != 0 {
+		mode = attr.Perms
+	} else if s.DefaultFileMode != 0 {
+		mode = s.DefaultFileMode
+	}
+	return s.applyUmask(mode)
+}
+
+// dirAttr returns the attributes with which to create a directory, filling in
+// the default permissions if the client did not specify any.
+func (s *server) dirAttr(attr *FileAttr) *FileAttr {
+	withPerms := *attr
+	if attr.Flags&AttrFlagPermissions == 0 {
+		withPerms.Flags |= AttrFlagPermissions
+		withPerms.Perms = s.DefaultDirMode
+		if withPerms.Perms == 0 {
+			withPerms.Perms = 0755
+		}
+	}
+	withPerms.Perms = s.applyUmask(withPerms.Perms)
+	return &withPerms
+}
+
+// applyUmask clears the configured umask from the permission bits of mode.
+func (s *server) applyUmask(mode os.FileMode) os.FileMode {
+	return mode &^ (s.Umask & os.ModePerm)
+}
+
+// longName produces the SSH_FXP_NAME long name for the given file.
+func (s *server) longName(fi os.FileInfo) string {
+	if s.LongNameFormatter != nil {
+		return s.LongNameFormatter(fi)
+	}
+	return runLs(fi)
+}
+
+// symlinkFollowsSpec reports whether SSH_FXP_SYMLINK requests send their paths
+// in the order given by the spec, rather than OpenSSH's reversed order.
+func (s *server) symlinkFollowsSpec() bool {
+	switch s.SymlinkOrder {
+	case SymlinkOrderOpenSSH:
+		return false
+	case SymlinkOrderSpec:
+		return true
+	}
+	// Without a banner, assume the most common case, as before it was known
+	return s.ClientVersion != "" && !strings.HasPrefix(s.ClientVersion, "SSH-2.0-OpenSSH")
+}
+
+// readdirItems returns the maximum number of entries to send in reply to each
+// SSH_FXP_READDIR.
+func (s *server) readdirItems() int {
+	if s.MaxReaddirItems > 0 {
+		return s.MaxReaddirItems
+	}
+	return MaxReaddirItems
+}
+
+// fitNameItems returns how many of the given items, at least one, fit in an
+// SSH_FXP_NAME reply no longer than maxPacketLength.
+func fitNameItems(items []fxpNamePktItem) int {
+	size := 1 + 4 + 4 // type, ID and count
+	for i, item := range items {
+		size += 4 + len(item.Name) + 4 + len(item.LongName) + item.Attr.encodedSize()
+		if size > maxPacketLength && i > 0 {
+			return i
+		}
+	}
+	return len(items)
+}
+
+// nameItems builds the SSH_FXP_NAME items listing the given entries of the
+// directory at dirpath.
+func (s *server) nameItems(dirpath string, files []os.FileInfo) []fxpNamePktItem {
+	items := make([]fxpNamePktItem, len(files))
+	attrs := make([]FileAttr, len(files)) // rather than one allocation per entry
+	for i, f := range files {
+		items[i].Name = s.normalize(entryName(f))
+		items[i].LongName = s.longName(f)
+		items[i].Attr = fileAttrFromInfoInto(f, &attrs[i])
+		if s.AttrRewriter != nil {
+			items[i].Attr = s.rewriteAttr(path.Join(dirpath, entryName(f)), items[i].Attr)
+		}
+		if s.ReaddirAttrs != ReaddirAttrsFull {
+			attrs[i] = *items[i].Attr // since it may be shared with the handler
+			attrs[i].Flags &= s.readdirAttrFlags()
+			items[i].Attr = &attrs[i]
+		}
+	}
+	return items
+}
+
+// readdirAttrFlags returns the attribute flags to keep in SSH_FXP_READDIR
+// replies.
+func (s *server) readdirAttrFlags() attrFlag {
+	switch s.ReaddirAttrs {
+	case ReaddirAttrsSizeMode:
+		return AttrFlagSize | AttrFlagPermissions
+	case ReaddirAttrsNone:
+		return 0
+	}
+	return ^attrFlag(0)
+}
+
+// statAttr returns the attributes to reply to a stat of the given path with.
+func (s *server) statAttr(fpath string, info os.FileInfo) *FileAttr {
+	attr := fileAttrFromInfo(info)
+	if s.ReportInodes {
+		attr = withInode(info, attr)
+	}
+	return s.rewriteAttr(fpath, attr)
+}
+
+// rewriteAttr applies ServerOpts.AttrRewriter to a copy of the attributes of
+// the given path, since they may be shared with the handler.
+func (s *server) rewriteAttr(fpath string, attr *FileAttr) *FileAttr {
+	if s.AttrRewriter == nil {
+		return attr
+	}
+	rewritten := *attr
+	if ret := s.AttrRewriter(fpath, &rewritten); ret != nil {
+		return ret
+	}
+	return &rewritten
+}
+
+// realpathReply builds the reply to an SSH_FXP_REALPATH request which resolved
+// to the given absolute path. The long name is the path itself unless a custom
+// LongNameFormatter is configured and the path can be stat'd.
+func (s *server) realpathReply(id uint32, abs string) *fxpNamePkt {
+	longName := abs
+	if s.LongNameFormatter != nil {
+		if info, err := s.Stat(abs); err == nil {
+			longName = s.LongNameFormatter(info)
+		}
+	}
+	return &fxpNamePkt{id, []fxpNamePktItem{{abs, longName, &FileAttr{}}}}
+}
+
+// normalize normalizes the given name if Unicode normalization is enabled.
+func (s *server) normalize(name string) string {
+	if s.NormalizeUnicode {
+		return s.UnicodeForm.String(name)
+	}
+	return name
+}
+
+// resolvePath normalizes and cleans the given path, joining it against the
+// working directory if it is relative and a working directory is configured.
+func (s *server) resolvePath(p string) string {
+	p = s.normalize(p)
+	if s.WorkDir != "" && !path.IsAbs(p) {
+		return path.Join(s.WorkDir, p)
+	}
+	return path.Clean(p)
+}
+
+// readClamped records that a read of the given length was clamped.
+func (s *server) readClamped(requested uint32) {
+	debug("read clamped [requested=%d max=%d]", requested, maxReadWriteSize)
+	if s.OnReadClamped != nil {
+		s.OnReadClamped(requested)
 	}
-	_, err = s.Write(b)
-	return err
 }
 
 func clamp(v, max uint32) uint32 {
@@ -366,50 +1191,196 @@ func (s *server) nextHandle() string {
 	)
 }
 
+// checkHandleLimit returns an error if the client may not open another handle.
+func (s *server) checkHandleLimit() error {
+	if s.MaxOpenHandles <= 0 {
+		return nil
+	}
+	s.openFilesMtx.RLock()
+	open := len(s.openFiles)
+	s.openFilesMtx.RUnlock()
+	s.openDirsMtx.RLock()
+	open += len(s.openDirs)
+	s.openDirsMtx.RUnlock()
+
+	if open >= s.MaxOpenHandles {
+		return ErrGeneric.WithMessagef("too many open handles (limit %d)", s.MaxOpenHandles)
+	}
+	return nil
+}
+
 func (s *server) getFile(handle string) (FileHandle, error) {
 	s.openFilesMtx.RLock()
-	defer s.openFilesMtx.RUnlock()
-	if f, exists := s.openFiles[handle]; exists {
+	f, exists := s.openFiles[handle]
+	s.openFilesMtx.RUnlock()
+	if exists {
 		return f, nil
 	}
+	if s.isDirHandle(handle) {
+		return nil, errHandleIsDir
+	}
 	return nil, errNoSuchHandle
 }
 
+func (s *server) isFileHandle(handle string) bool {
+	s.openFilesMtx.RLock()
+	defer s.openFilesMtx.RUnlock()
+	_, exists := s.openFiles[handle]
+	return exists
+}
+
+// closeFile flushes and closes the file, after removing its handle from the
+// session, so that a slow flush does not block operations on other handles.
 func (s *server) closeFile(handle string) error {
 	s.openFilesMtx.Lock()
-	defer s.openFilesMtx.Unlock()
-	if f, exists := s.openFiles[handle]; exists {
-		delete(s.openFiles, handle)
-		return f.Close()
+	f, exists := s.openFiles[handle]
+	delete(s.openFiles, handle)
+	s.openFilesMtx.Unlock()
+	if !exists {
+		return errNoSuchHandle
 	}
-	return errNoSuchHandle
+	s.setHandlePath(handle, "")
+	if err := flushFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-func (s *server) getDir(handle string) (DirReader, error) {
+// readAt reads from the file at the given offset, passing it the context if
+// it is a ContextReaderAt.
+func readAt(ctx context.Context, f FileHandle, p []byte, off int64) (int, error) {
+	if cr, ok := f.(ContextReaderAt); ok {
+		return cr.ReadAtContext(ctx, p, off)
+	}
+	return f.ReadAt(p, off)
+}
+
+// writeAt writes to the file at the given offset, passing it the context if it
+// is a ContextWriterAt.
+func writeAt(ctx context.Context, f FileHandle, p []byte, off int64) (int, error) {
+	if cw, ok := f.(ContextWriterAt); ok {
+		return cw.WriteAtContext(ctx, p, off)
+	}
+	return f.WriteAt(p, off)
+}
+
+// writeFull writes all of data to the file at the given offset; writing no data
+// is a no-op which always succeeds. The io.WriterAt contract requires a non-nil
+// error for short writes, but not every implementation honors it, so keep
+// writing the remainder until it is done or no progress is made.
+func writeFull(ctx context.Context, f FileHandle, data []byte, offset int64) error {
+	for len(data) > 0 {
+		n, err := writeAt(ctx, f, data, offset)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+		offset += int64(n)
+	}
+	return nil
+}
+
+// preallocateSize returns the size to preallocate for the file opened by the
+// given request, or zero for none. Space is only preallocated for files which
+// the request leaves empty, by creating them or truncating them, and which the
+// client will write.
+func (s *server) preallocateSize(pkt *fxpOpenPkt) int64 {
+	if pkt.PFlags&PFlagWrite == 0 || pkt.PFlags&(PFlagTruncate|PFlagExclusive) == 0 ||
+		pkt.Attr.Flags&AttrFlagSize == 0 || s.MaxPreallocate <= 0 {
+		return 0
+	}
+	if pkt.Attr.Size > uint64(s.MaxPreallocate) {
+		return s.MaxPreallocate
+	}
+	return int64(pkt.Attr.Size)
+}
+
+// preallocate passes the given size to the file as a preallocation hint, if it
+// is a Preallocator.
+func preallocate(f FileHandle, size int64) {
+	if p, ok := f.(Preallocator); ok {
+		if err := p.Preallocate(size); err != nil {
+			debug("preallocate [size=%d]: error: %v", size, err)
+		}
+	}
+}
+
+// statFile retrieves up-to-date info about the given file.
+func statFile(f FileHandle) (os.FileInfo, error) {
+	if statter, ok := f.(FileStatter); ok {
+		return statter.Stat()
+	}
+	return f, nil
+}
+
+// flushFile flushes any writes buffered by the given file, if it supports it.
+func flushFile(f FileHandle) error {
+	if flusher, ok := f.(Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	if syncer, ok := f.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (s *server) getDir(handle string) (*syncDirReader, error) {
 	s.openDirsMtx.RLock()
-	defer s.openDirsMtx.RUnlock()
-	if d, exists := s.openDirs[handle]; exists {
+	d, exists := s.openDirs[handle]
+	s.openDirsMtx.RUnlock()
+	if exists {
 		return d, nil
 	}
+	if s.isFileHandle(handle) {
+		return nil, errHandleIsFile
+	}
 	return nil, errNoSuchHandle
 }
 
+func (s *server) isDirHandle(handle string) bool {
+	s.openDirsMtx.RLock()
+	defer s.openDirsMtx.RUnlock()
+	_, exists := s.openDirs[handle]
+	return exists
+}
+
 func (s *server) closeDir(handle string) error {
 	s.openDirsMtx.Lock()
 	defer s.openDirsMtx.Unlock()
 	if d, exists := s.openDirs[handle]; exists {
 		delete(s.openDirs, handle)
-		if closer, ok := d.(io.Closer); ok {
-			return closer.Close()
-		}
-		return nil
+		s.setHandlePath(handle, "")
+		return d.Close()
 	}
 	return errNoSuchHandle
 }
 
+// endSession closes any handles opened while the session was ending, then
+// reports the session's statistics.
+func (s *server) endSession() {
+	s.closeAllHandles()
+	stats := SessionStats{
+		HandlesClosed:      int(atomic.LoadUint64(&s.handlesClosed)),
+		HandlesForceClosed: int(atomic.LoadUint64(&s.handlesForceClosed)),
+	}
+	if stats.HandlesForceClosed > 0 {
+		s.logf("sftp: session ended with %d handles left open by the client", stats.HandlesForceClosed)
+	}
+	if s.OnSessionEnd != nil {
+		s.OnSessionEnd(stats)
+	}
+}
+
 // closeAllHandles closes all open file/directory handles.
 func (s *server) closeAllHandles() {
 	s.openFilesMtx.Lock()
+	atomic.AddUint64(&s.handlesForceClosed, uint64(len(s.openFiles)))
 	for handle, file := range s.openFiles {
 		file.Close() // TODO(samterainsights): propagate error somehow
 		delete(s.openFiles, handle)
@@ -417,11 +1388,33 @@ func (s *server) closeAllHandles() {
 	s.openFilesMtx.Unlock()
 
 	s.openDirsMtx.Lock()
+	atomic.AddUint64(&s.handlesForceClosed, uint64(len(s.openDirs)))
 	for handle, dir := range s.openDirs {
-		if closer, ok := dir.(io.Closer); ok {
-			closer.Close() // TODO(samterainsights): propagate error somehow
-		}
+		dir.Close() // TODO(samterainsights): propagate error somehow
 		delete(s.openDirs, handle)
 	}
 	s.openDirsMtx.Unlock()
+
+	s.handlePathsMtx.Lock()
+	s.handlePaths = make(map[string]string)
+	s.handlePathsMtx.Unlock()
+}
+
+// setHandlePath records the path the given handle was opened with, or forgets
+// it if fpath is empty.
+func (s *server) setHandlePath(handle, fpath string) {
+	s.handlePathsMtx.Lock()
+	defer s.handlePathsMtx.Unlock()
+	if fpath == "" {
+		delete(s.handlePaths, handle)
+	} else {
+		s.handlePaths[handle] = fpath
+	}
+}
+
+// handlePath returns the path the given handle was opened with.
+func (s *server) handlePath(handle string) string {
+	s.handlePathsMtx.Lock()
+	defer s.handlePathsMtx.Unlock()
+	return s.handlePaths[handle]
 }
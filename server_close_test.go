@@ -0,0 +1,117 @@
+package sftp_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tera-insights/sftp"
+)
+
+// flushFS serves MemFS files whose Flush blocks until it receives the error to
+// return, like a handler buffering writes to a slow backend.
+type flushFS struct {
+	sftp.RequestHandler
+	flushing chan struct{}
+	flushErr chan error
+	reading  chan struct{}
+}
+
+func newFlushFS() *flushFS {
+	return &flushFS{
+		RequestHandler: sftp.MemFS(),
+		flushing:       make(chan struct{}, 1),
+		flushErr:       make(chan error, 1),
+		reading:        make(chan struct{}, 1),
+	}
+}
+
+func (fs *flushFS) OpenFile(name string, flag int, perm os.FileMode) (sftp.FileHandle, error) {
+	f, err := fs.RequestHandler.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return flushFile{f, fs}, nil
+}
+
+type flushFile struct {
+	sftp.FileHandle
+	fs *flushFS
+}
+
+func (f flushFile) Flush() error {
+	f.fs.flushing <- struct{}{}
+	return <-f.fs.flushErr
+}
+
+func (f flushFile) ReadAt(p []byte, off int64) (int, error) {
+	select {
+	case f.fs.reading <- struct{}{}:
+	default:
+	}
+	return f.FileHandle.ReadAt(p, off)
+}
+
+// TestCloseFlushes checks that SSH_FXP_CLOSE is only answered once the handle
+// has been flushed, without blocking requests on other handles meanwhile.
+func TestCloseFlushes(t *testing.T) {
+	fs := newFlushFS()
+	c := serve(t, fs, sftp.ServerOpts{})
+	flags := uint32(sftp.PFlagRead | sftp.PFlagWrite | sftp.PFlagCreate)
+	buffered := open(t, c, "/buffered", flags)
+	other := open(t, c, "/other", flags)
+
+	replies := make(chan []byte, 1)
+	c.Send(fxpClose, uint32(2), buffered)
+	<-fs.flushing
+	defer func() {
+		// Let the session end if the test failed with the flush blocked
+		select {
+		case fs.flushErr <- nil:
+		default:
+		}
+	}()
+	go func() {
+		_, b, _ := c.Recv()
+		replies <- b
+	}()
+
+	c.Send(fxpRead, uint32(3), other, uint64(0), uint32(10))
+	select {
+	case <-fs.reading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("READ on another handle blocked by a flush in progress")
+	}
+	select {
+	case <-replies:
+		t.Fatal("SSH_FXP_CLOSE answered before the flush finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fs.flushErr <- nil
+	if b := <-replies; len(b) < 8 || binary.BigEndian.Uint32(b) != 2 || binary.BigEndian.Uint32(b[4:]) != code(nil) {
+		t.Fatalf("received %x in reply to SSH_FXP_CLOSE, want success", b)
+	}
+	expectStatus(t, c, 3, sftp.ErrEOF)
+}
+
+// TestCloseFlushError checks that a handle which fails to flush is reported to
+// the client as a failure to close it.
+func TestCloseFlushError(t *testing.T) {
+	fs := newFlushFS()
+	c := serve(t, fs, sftp.ServerOpts{})
+	handle := open(t, c, "/file", uint32(sftp.PFlagWrite|sftp.PFlagCreate))
+
+	fs.flushErr <- errors.New("backend unavailable")
+	c.Send(fxpClose, uint32(2), handle)
+	<-fs.flushing
+	expectStatus(t, c, 2, sftp.ErrGeneric)
+
+	// The handle is gone even though closing it failed
+	c.Send(fxpClose, uint32(3), handle)
+	if _, got := recvStatus(t, c); got == code(nil) {
+		t.Fatal("handle could be closed twice")
+	}
+}
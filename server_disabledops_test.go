@@ -0,0 +1,55 @@
+package sftp_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/tera-insights/sftp"
+)
+
+// TestDisabledOps disables renaming and symlinking but not removing, and checks
+// that only the disabled requests are refused, without reaching the handler.
+func TestDisabledOps(t *testing.T) {
+	fs := sftp.MemFS()
+	for _, name := range []string{"/a", "/b"} {
+		f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	c := serve(t, fs, sftp.ServerOpts{DisabledOps: []string{"SSH_FXP_RENAME", "SSH_FXP_SYMLINK"}})
+
+	c.Send(fxpRename, uint32(2), "/a", "/renamed")
+	expectStatus(t, c, 2, sftp.ErrOpUnsupported)
+	c.Send(fxpSymlink, uint32(3), "/a", "/link")
+	expectStatus(t, c, 3, sftp.ErrOpUnsupported)
+	for _, name := range []string{"/renamed", "/link"} {
+		if _, err := fs.Lstat(name); err == nil {
+			t.Errorf("%s was created by a disabled request", name)
+		}
+	}
+
+	c.Send(fxpRemove, uint32(4), "/b")
+	expectStatus(t, c, 4, nil)
+	if _, err := fs.Lstat("/b"); err == nil {
+		t.Error("/b was not removed")
+	}
+}
+
+// TestDisabledExtended checks that disabling extended requests refuses those,
+// but that malformed requests of other types are still answered
+// SSH_FX_BAD_MESSAGE rather than being taken for extended ones.
+func TestDisabledExtended(t *testing.T) {
+	c := serve(t, sftp.MemFS(), sftp.ServerOpts{DisabledOps: []string{"SSH_FXP_EXTENDED"}})
+
+	c.Send(fxpExtended, uint32(2), "statvfs@openssh.com", "/")
+	expectStatus(t, c, 2, sftp.ErrOpUnsupported)
+	c.Send(fxpExtended, uint32(3), "nosuch@example.com")
+	expectStatus(t, c, 3, sftp.ErrOpUnsupported)
+
+	c.Send(fxpWrite, uint32(4), "handle") // missing its offset and data
+	expectStatus(t, c, 4, sftp.ErrBadMessage)
+	c.Send(fxpOpen, uint32(5), "/file") // missing its flags and attributes
+	expectStatus(t, c, 5, sftp.ErrBadMessage)
+}
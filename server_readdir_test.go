@@ -0,0 +1,56 @@
+package sftp
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+// BenchmarkReaddir builds and marshals the SSH_FXP_NAME reply listing a
+// directory of 100 files, as served for each SSH_FXP_READDIR, reporting the
+// allocations made per reply.
+func BenchmarkReaddir(b *testing.B) {
+	const n = 100
+	for _, bc := range []struct {
+		name       string
+		newHandler func(b *testing.B) (RequestHandler, string)
+	}{
+		{"MemFS", func(b *testing.B) (RequestHandler, string) {
+			return MemFS(), "/"
+		}},
+		{"HostFS", func(b *testing.B) (RequestHandler, string) {
+			return HostFS(HostFSOpts{AllowWrite: true}), b.TempDir()
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			h, dir := bc.newHandler(b)
+			for i := 0; i < n; i++ {
+				f, err := h.OpenFile(path.Join(dir, fmt.Sprintf("file%03d", i)), os.O_WRONLY|os.O_CREATE, 0644)
+				if err != nil {
+					b.Fatal(err)
+				}
+				f.WriteAt([]byte("data"), 0)
+				f.Close()
+			}
+			d, err := h.OpenDir(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			files := make([]os.FileInfo, n)
+			if got, _ := d.ReadEntries(files); got != n {
+				b.Fatalf("listed %d entries, want %d", got, n)
+			}
+
+			s := &server{}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pkt := &fxpNamePkt{uint32(i), s.nameItems(dir, files)}
+				if _, err := pkt.MarshalBinary(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
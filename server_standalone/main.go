@@ -6,12 +6,12 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
 
 	"github.com/tera-insights/sftp"
+	"github.com/tera-insights/sftp/sftpssh"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -97,54 +97,9 @@ func handleConn(c net.Conn) {
 	// or the connection will hang
 	go ssh.DiscardRequests(reqs)
 
-	// Service the incoming Channel channel.
-	for newChannel := range chans {
-		log.Printf("Incoming SSH channel: %s", newChannel.ChannelType())
-
-		// At the SSH application level, we only care about "session" channels,
-		// which SFTP is served through
-		if newChannel.ChannelType() != "session" {
-			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-			log.Printf("Unknown channel type: %s\n", newChannel.ChannelType())
-			continue
-		}
-
-		channel, requests, err := newChannel.Accept()
-		if err != nil {
-			log.Printf("Failed to accept channel: %v", err)
-			continue
-		}
-		log.Println("Channel accepted")
-
-		go filterNonSFTP(requests)
-
-		log.Printf("serving sftp")
-		if err = sftp.Serve(channel, sftp.MemFS()); err == io.EOF {
-			log.Println("SFTP client killed session")
-
-			if err = channel.Close(); err != nil {
-				log.Printf("Failed to gracefully close SSH connection: %v", err)
-			}
-		} else if err != nil {
-			log.Printf("SFTP disconnected unexpectedly: %v", err)
-		}
-	}
-}
-
-// filterNonSFTP lets through SFTP subsystem requests and rejects everything else.
-func filterNonSFTP(in <-chan *ssh.Request) {
-	for req := range in {
-		switch req.Type {
-		case "subsystem":
-			log.Printf("Got 'subsystem' request: %s", req.Payload)
-			if string(req.Payload[4:]) == "sftp" {
-				req.Reply(true, nil)
-				continue
-			}
-			fallthrough
-		default:
-			log.Printf("Rejecting request [type: %s, payload: %s]", req.Type, req.Payload)
-			req.Reply(false, nil)
-		}
-	}
+	// Serve SFTP over each "session" channel concurrently
+	sftpssh.ServeChannels(chans, sftp.MemFS(), func(err error) {
+		log.Printf("SFTP session ended unexpectedly: %v", err)
+	})
+	log.Println("SSH connection closed")
 }
@@ -4,11 +4,11 @@ package sftp
 
 import (
 	"os"
+	"strconv"
 	"time"
-	"fmt"
 )
 
-func runLs(dirname string, dirent os.FileInfo) string {
+func runLs(dirent os.FileInfo) string {
 	typeword := runLsTypeWord(dirent)
 	numLinks := 1
 	if dirent.IsDir() {
@@ -23,10 +23,10 @@ func runLs(dirname string, dirent os.FileInfo) string {
 	now := time.Now()
 	isOld := mtime.Before(now.Add(-time.Hour * 24 * 365 / 2))
 
-	yearOrTime := fmt.Sprintf("%02d:%02d", mtime.Hour(), mtime.Minute())
+	yearOrTime := mtime.Format("15:04")
 	if isOld {
-		yearOrTime = fmt.Sprintf("%d", year)
+		yearOrTime = strconv.Itoa(year)
 	}
 
-	return fmt.Sprintf("%s %4d %-8s %-8s %8d %s %2d %5s %s", typeword, numLinks, username, groupname, dirent.Size(), monthStr, day, yearOrTime, dirent.Name())
+	return runLsFormat(typeword, strconv.Itoa(numLinks), username, groupname, strconv.FormatInt(dirent.Size(), 10), monthStr, strconv.Itoa(day), yearOrTime, dirent.Name())
 }
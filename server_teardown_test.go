@@ -0,0 +1,120 @@
+package sftp_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tera-insights/sftp"
+	"github.com/tera-insights/sftp/sftptest"
+)
+
+// blockingFS serves MemFS files whose reads block until their context is
+// canceled, like a handler reading from a stalled backend.
+type blockingFS struct {
+	sftp.RequestHandler
+	reading  chan struct{}
+	canceled chan error
+}
+
+func (fs *blockingFS) OpenFile(name string, flag int, perm os.FileMode) (sftp.FileHandle, error) {
+	f, err := fs.RequestHandler.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return blockingFile{f, fs}, nil
+}
+
+type blockingFile struct {
+	sftp.FileHandle
+	fs *blockingFS
+}
+
+func (f blockingFile) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	f.fs.reading <- struct{}{}
+	<-ctx.Done()
+	f.fs.canceled <- ctx.Err()
+	return 0, ctx.Err()
+}
+
+// TestTeardownAbandonsBlockedRead closes a handle whose read is blocked in the
+// handler, then ends the session, and checks that the read's context is
+// canceled so that the session ends promptly.
+func TestTeardownAbandonsBlockedRead(t *testing.T) {
+	fs := &blockingFS{
+		RequestHandler: sftp.MemFS(),
+		reading:        make(chan struct{}, 1),
+		canceled:       make(chan error, 1),
+	}
+	c, done := sftptest.ServePipe(fs, sftp.ServerOpts{})
+	if _, _, err := c.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	handle := open(t, c, "/file", uint32(sftp.PFlagRead|sftp.PFlagCreate))
+
+	c.Send(fxpRead, uint32(2), handle, uint64(0), uint32(1024))
+	<-fs.reading
+	c.Send(fxpClose, uint32(3), handle)
+	c.Close()
+
+	select {
+	case err := <-fs.canceled:
+		if err != context.Canceled {
+			t.Errorf("read abandoned with %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked read was not canceled when the session ended")
+	}
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Errorf("session ended with %v, want io.EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end")
+	}
+}
+
+// TestDisconnectKeepsPipelinedUpload sends a WRITE and a CLOSE for an atomic
+// upload and disconnects without waiting for their replies, while an earlier
+// request is still being handled, and checks that the upload is nevertheless
+// written and published.
+func TestDisconnectKeepsPipelinedUpload(t *testing.T) {
+	fs := newFlushFS()
+	h := sftp.AtomicUploads(fs, func(name string) bool { return name == "/upload" })
+	c, done := sftptest.ServePipe(h, sftp.ServerOpts{})
+	if _, _, err := c.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	slow := open(t, c, "/slow", uint32(sftp.PFlagWrite|sftp.PFlagCreate))
+	upload := open(t, c, "/upload", uint32(sftp.PFlagWrite|sftp.PFlagCreate|sftp.PFlagTruncate))
+
+	c.Send(fxpClose, uint32(2), slow)
+	<-fs.flushing
+	c.Send(fxpWrite, uint32(3), upload, uint64(0), "hello")
+	c.Send(fxpClose, uint32(4), upload)
+	c.Close()
+
+	// Give the server time to see the disconnect before letting the first
+	// CLOSE, and every flush after it, finish
+	time.Sleep(50 * time.Millisecond)
+	close(fs.flushErr)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end")
+	}
+
+	f, err := fs.RequestHandler.OpenFile("/upload", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("upload was lost: %v", err)
+	}
+	defer f.Close()
+	b := make([]byte, 16)
+	n, _ := f.ReadAt(b, 0)
+	if got := string(b[:n]); got != "hello" {
+		t.Fatalf("upload contains %q, want %q", got, "hello")
+	}
+}
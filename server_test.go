@@ -0,0 +1,196 @@
+package sftp_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/tera-insights/sftp"
+	"github.com/tera-insights/sftp/sftptest"
+)
+
+// Packet types used by the tests, as numbered in
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-02#section-3.
+const (
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRename   = 18
+	fxpReadlink = 19
+	fxpSymlink  = 20
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpExtended = 200
+)
+
+// serve serves the handler over a pipe until the end of the test, and returns
+// an initialized client for it.
+func serve(t testing.TB, h sftp.RequestHandler, opts sftp.ServerOpts) *sftptest.Client {
+	t.Helper()
+	c, done := sftptest.ServePipe(h, opts)
+	t.Cleanup(func() {
+		c.Close()
+		<-done
+	})
+	if _, _, err := c.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return c
+}
+
+// code returns the status code a request failing with err is answered with.
+func code(err error) uint32 {
+	return sftp.StatusFromError(err).Code
+}
+
+// recvStatus receives a reply which must be SSH_FXP_STATUS, and returns its
+// request ID and status code.
+func recvStatus(t testing.TB, c *sftptest.Client) (id, code uint32) {
+	t.Helper()
+	b := recv(t, c, fxpStatus)
+	if len(b) < 8 {
+		t.Fatalf("received a short SSH_FXP_STATUS")
+	}
+	return binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+}
+
+// expectStatus receives a reply which must be SSH_FXP_STATUS for the given
+// request, with the status code a request failing with err is answered with.
+func expectStatus(t testing.TB, c *sftptest.Client, id uint32, err error) {
+	t.Helper()
+	gotID, got := recvStatus(t, c)
+	if gotID != id || got != code(err) {
+		t.Fatalf("received status %d for request %d; want status %d for request %d",
+			got, gotID, code(err), id)
+	}
+}
+
+// recv receives a reply which must be of the given type, and returns the data
+// which follows its type.
+func recv(t testing.TB, c *sftptest.Client, want byte) []byte {
+	t.Helper()
+	typ, b, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if typ != want {
+		if typ == fxpStatus && len(b) >= 8 {
+			t.Fatalf("received status %d, want packet type %d", binary.BigEndian.Uint32(b[4:]), want)
+		}
+		t.Fatalf("received packet type %d, want %d", typ, want)
+	}
+	return b
+}
+
+// recvHandle receives a reply which must be SSH_FXP_HANDLE, and returns the
+// handle.
+func recvHandle(t testing.TB, c *sftptest.Client) string {
+	t.Helper()
+	b := recv(t, c, fxpHandle)
+	if len(b) < 8 || uint32(len(b)-8) < binary.BigEndian.Uint32(b[4:]) {
+		t.Fatalf("received a short SSH_FXP_HANDLE")
+	}
+	return string(b[8 : 8+binary.BigEndian.Uint32(b[4:])])
+}
+
+// open opens the file with the given SFTP pflags and returns its handle.
+func open(t testing.TB, c *sftptest.Client, name string, pflags uint32) string {
+	t.Helper()
+	c.Send(fxpOpen, uint32(1), name, pflags, uint32(0))
+	return recvHandle(t, c)
+}
+
+// opendir opens the directory and returns its handle.
+func opendir(t testing.TB, c *sftptest.Client, name string) string {
+	t.Helper()
+	c.Send(fxpOpendir, uint32(1), name)
+	return recvHandle(t, c)
+}
+
+// A nameEntry is an entry of an SSH_FXP_NAME reply.
+type nameEntry struct {
+	name, longName string
+	flags, mode    uint32
+}
+
+// readdir sends SSH_FXP_READDIR for the handle, and returns the entries of the
+// reply, or nil once the listing is exhausted.
+func readdir(t testing.TB, c *sftptest.Client, handle string) []nameEntry {
+	t.Helper()
+	c.Send(fxpReaddir, uint32(1), handle)
+	typ, b, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if typ == fxpStatus {
+		if len(b) < 8 || binary.BigEndian.Uint32(b[4:]) != code(sftp.ErrEOF) {
+			t.Fatalf("received %x in reply to SSH_FXP_READDIR, want SSH_FXP_NAME or EOF", b)
+		}
+		return nil
+	} else if typ != fxpName {
+		t.Fatalf("received packet type %d in reply to SSH_FXP_READDIR", typ)
+	}
+
+	r := reader{t: t, b: b}
+	r.u32() // ID
+	entries := make([]nameEntry, r.u32())
+	for i := range entries {
+		e := &entries[i]
+		e.name, e.longName = r.str(), r.str()
+		if e.flags = r.u32(); e.flags&uint32(sftp.AttrFlagSize) != 0 {
+			r.u32()
+			r.u32()
+		}
+		if e.flags&uint32(sftp.AttrFlagUIDGID) != 0 {
+			r.u32()
+			r.u32()
+		}
+		if e.flags&uint32(sftp.AttrFlagPermissions) != 0 {
+			e.mode = r.u32()
+		}
+		if e.flags&uint32(sftp.AttrFlagAcModTime) != 0 {
+			r.u32()
+			r.u32()
+		}
+		if e.flags&uint32(sftp.AttrFlagExtended) != 0 {
+			for n := r.u32(); n > 0; n-- {
+				r.str()
+				r.str()
+			}
+		}
+	}
+	return entries
+}
+
+// reader decodes the fields of a packet, failing the test if it is too short.
+type reader struct {
+	t testing.TB
+	b []byte
+}
+
+func (r *reader) u32() uint32 {
+	r.t.Helper()
+	if len(r.b) < 4 {
+		r.t.Fatal("received a short packet")
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *reader) str() string {
+	r.t.Helper()
+	n := r.u32()
+	if uint32(len(r.b)) < n {
+		r.t.Fatal("received a short packet")
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
@@ -6,9 +6,11 @@ package sftp
 import (
 	"fmt"
 	"os"
-	"path"
+	"strconv"
 	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func runLsStatt(dirent os.FileInfo, statt *syscall.Stat_t) string {
@@ -21,8 +23,8 @@ func runLsStatt(dirent os.FileInfo, statt *syscall.Stat_t) string {
 	numLinks := statt.Nlink
 	uid := statt.Uid
 	gid := statt.Gid
-	username := fmt.Sprintf("%d", uid)
-	groupname := fmt.Sprintf("%d", gid)
+	username := strconv.FormatUint(uint64(uid), 10)
+	groupname := strconv.FormatUint(uint64(gid), 10)
 	// TODO FIXME: uid -> username, gid -> groupname lookup for ls -l format output
 
 	mtime := dirent.ModTime()
@@ -32,17 +34,24 @@ func runLsStatt(dirent os.FileInfo, statt *syscall.Stat_t) string {
 	now := time.Now()
 	isOld := mtime.Before(now.Add(-time.Hour * 24 * 365 / 2))
 
-	yearOrTime := fmt.Sprintf("%02d:%02d", mtime.Hour(), mtime.Minute())
+	yearOrTime := mtime.Format("15:04")
 	if isOld {
-		yearOrTime = fmt.Sprintf("%d", year)
+		yearOrTime = strconv.Itoa(year)
+	}
+
+	// device files show "major, minor" in place of the size
+	sizeStr := strconv.FormatInt(dirent.Size(), 10)
+	if dirent.Mode()&os.ModeDevice != 0 {
+		rdev := uint64(statt.Rdev)
+		sizeStr = fmt.Sprintf("%d, %3d", unix.Major(rdev), unix.Minor(rdev))
 	}
 
-	return fmt.Sprintf("%s %4d %-8s %-8s %8d %s %2d %5s %s", typeword, numLinks, username, groupname, dirent.Size(), monthStr, day, yearOrTime, dirent.Name())
+	return runLsFormat(typeword, strconv.FormatUint(uint64(numLinks), 10), username, groupname, sizeStr, monthStr, strconv.Itoa(day), yearOrTime, dirent.Name())
 }
 
 // ls -l style output for a file, which is in the 'long output' section of a readdir response packet
 // this is a very simple (lazy) implementation, just enough to look almost like openssh in a few basic cases
-func runLs(dirname string, dirent os.FileInfo) string {
+func runLs(dirent os.FileInfo) string {
 	dsys := dirent.Sys()
 	if dsys == nil {
 	} else if statt, ok := dsys.(*syscall.Stat_t); !ok {
@@ -50,5 +59,5 @@ func runLs(dirname string, dirent os.FileInfo) string {
 		return runLsStatt(dirent, statt)
 	}
 
-	return path.Join(dirname, dirent.Name())
+	return dirent.Name()
 }
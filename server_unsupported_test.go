@@ -0,0 +1,46 @@
+package sftp_test
+
+import (
+	"testing"
+
+	"github.com/tera-insights/sftp"
+)
+
+// noSymlinks is a RequestHandler which reports that it supports neither
+// symlinks nor any extension.
+type noSymlinks struct {
+	sftp.RequestHandler
+}
+
+func (noSymlinks) Capabilities() sftp.Capabilities {
+	return sftp.Capabilities{}
+}
+
+// TestUnsupportedOperations checks that each kind of operation the server or
+// handler does not support is answered SSH_FX_OP_UNSUPPORTED, which is code 8,
+// so that clients can fall back rather than treat it as a failure.
+func TestUnsupportedOperations(t *testing.T) {
+	if got := code(sftp.ErrOpUnsupported); got != 8 {
+		t.Fatalf("ErrOpUnsupported has status code %d, want 8", got)
+	}
+
+	c := serve(t, noSymlinks{sftp.MemFS()}, sftp.ServerOpts{})
+	for i, tc := range []struct {
+		name    string
+		pktType byte
+		fields  []interface{}
+	}{
+		{"unknown packet type", 99, nil},
+		{"unknown extended request", fxpExtended, []interface{}{"nosuch@example.com", "/"}},
+		{"posix-rename without PosixRename", fxpExtended, []interface{}{"posix-rename@openssh.com", "/a", "/b"}},
+		{"statvfs without StatVFS", fxpExtended, []interface{}{"statvfs@openssh.com", "/"}},
+		{"SSH_FXP_READLINK without symlinks", fxpReadlink, []interface{}{"/link"}},
+		{"SSH_FXP_SYMLINK without symlinks", fxpSymlink, []interface{}{"/link", "/target"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			id := uint32(i + 2)
+			c.Send(tc.pktType, append([]interface{}{id}, tc.fields...)...)
+			expectStatus(t, c, id, sftp.ErrOpUnsupported)
+		})
+	}
+}
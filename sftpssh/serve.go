@@ -0,0 +1,107 @@
+// Package sftpssh serves SFTP over golang.org/x/crypto/ssh session channels.
+// It is kept separate so that the core sftp package does not depend on
+// x/crypto/ssh.
+package sftpssh
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tera-insights/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNoSubsystem is returned by ServeSSHChannel if the client stops sending
+// requests on the channel without requesting the "sftp" subsystem.
+var ErrNoSubsystem = errors.New("sftpssh: channel closed before sftp subsystem was requested")
+
+// ServeSSHChannel serves SFTP over an accepted "session" channel once the
+// client requests the "sftp" subsystem. All other channel requests are
+// rejected. The channel is closed when the session ends. A client closing
+// the session normally is not reported as an error.
+func ServeSSHChannel(channel ssh.Channel, requests <-chan *ssh.Request, handler sftp.RequestHandler) error {
+	defer channel.Close()
+
+	if !awaitSubsystem(requests) {
+		return ErrNoSubsystem
+	}
+	go rejectAll(requests)
+
+	if err := sftp.Serve(channel, handler); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// ServeChannels accepts the "session" channels of an SSH connection and serves
+// SFTP over each one concurrently with ServeSSHChannel, rejecting channels of
+// any other type. Every session shares the given handler, but has its own open
+// handles. If onError is non-nil, it is called with the error which ended any
+// session abnormally. ServeChannels returns once chans is closed, i.e. the
+// connection has ended, and all sessions have finished.
+func ServeChannels(chans <-chan ssh.NewChannel, handler sftp.RequestHandler, onError func(error)) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			if onError != nil {
+				onError(err)
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ServeSSHChannel(channel, requests, handler); err != nil && onError != nil {
+				onError(err)
+			}
+		}()
+	}
+}
+
+// awaitSubsystem services channel requests until the "sftp" subsystem is
+// requested, rejecting anything else. It returns false if the requests
+// channel is closed first.
+func awaitSubsystem(requests <-chan *ssh.Request) bool {
+	for req := range requests {
+		ok := req.Type == "subsystem" && subsystemName(req.Payload) == "sftp"
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// subsystemName parses the payload of a "subsystem" request, which is a single
+// SSH string: a uint32 length followed by that many bytes. An empty string is
+// returned if the payload is malformed.
+func subsystemName(payload []byte) string {
+	if len(payload) < 4 {
+		return ""
+	}
+	length := binary.BigEndian.Uint32(payload)
+	if uint64(length) != uint64(len(payload)-4) {
+		return ""
+	}
+	return string(payload[4:])
+}
+
+func rejectAll(requests <-chan *ssh.Request) {
+	for req := range requests {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package sftptest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/tera-insights/sftp"
+)
+
+// Packet types used by Client.Init. Others are as numbered in
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-02#section-3.
+const (
+	PacketInit    = 1 // SSH_FXP_INIT
+	PacketVersion = 2 // SSH_FXP_VERSION
+)
+
+// ServePipe serves the handler with the given options over one end of a
+// net.Pipe, and returns a Client for the other end, for testing a server
+// without SSH. The error which ended the session is sent on the returned
+// channel, e.g. io.EOF once the Client is closed.
+//
+// Since net.Pipe is unbuffered, the client must read every reply it is sent,
+// or the server will block writing them.
+func ServePipe(handler sftp.RequestHandler, opts sftp.ServerOpts) (*Client, <-chan error) {
+	clientConn, serverConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- sftp.ServeWithOpts(serverConn, handler, opts)
+		serverConn.Close()
+	}()
+	return NewClient(clientConn), done
+}
+
+// A Client is a minimal SFTP client which sends and receives raw packets,
+// framed with their length as on the wire, for exercising a server directly.
+// For example, to stat a file:
+//
+//	client.Send(17, uint32(1), "/some/path") // SSH_FXP_STAT with request ID 1
+//	typ, data, err := client.Recv()          // expect SSH_FXP_ATTRS (105)
+type Client struct {
+	conn io.ReadWriteCloser
+}
+
+// NewClient creates a Client over the given connection to a server.
+func NewClient(conn io.ReadWriteCloser) *Client {
+	return &Client{conn}
+}
+
+// Send sends a packet of the given type whose fields are encoded in order:
+// uint8, uint32 and uint64 values in big-endian byte order, strings prefixed
+// with their length, and []byte as-is. It panics if a field has any other type.
+func (c *Client) Send(pktType byte, fields ...interface{}) error {
+	b := []byte{0, 0, 0, 0, pktType}
+	for _, field := range fields {
+		switch v := field.(type) {
+		case uint8:
+			b = append(b, v)
+		case uint32:
+			b = appendU32(b, v)
+		case uint64:
+			b = appendU32(appendU32(b, uint32(v>>32)), uint32(v))
+		case string:
+			b = append(appendU32(b, uint32(len(v))), v...)
+		case []byte:
+			b = append(b, v...)
+		default:
+			panic(fmt.Sprintf("sftptest: cannot encode packet field of type %T", field))
+		}
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// Recv receives a packet, returning its type and the data which follows.
+func (c *Client) Recv() (pktType byte, data []byte, err error) {
+	var length [4]byte
+	if _, err = io.ReadFull(c.conn, length[:]); err != nil {
+		return
+	}
+	b := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if len(b) == 0 {
+		return 0, nil, errors.New("sftptest: received an empty packet")
+	}
+	if _, err = io.ReadFull(c.conn, b); err != nil {
+		return
+	}
+	return b[0], b[1:], nil
+}
+
+// Init sends SSH_FXP_INIT for sftp.ProtocolVersion, and returns the version
+// and extensions of the server's SSH_FXP_VERSION reply.
+func (c *Client) Init() (version uint32, extensions []sftp.Extension, err error) {
+	if err = c.Send(PacketInit, uint32(sftp.ProtocolVersion)); err != nil {
+		return
+	}
+	pktType, b, err := c.Recv()
+	if err != nil {
+		return
+	}
+	if pktType != PacketVersion {
+		return 0, nil, errors.Errorf("sftptest: received packet type %d, want SSH_FXP_VERSION", pktType)
+	}
+	if version, b, err = takeU32(b); err != nil {
+		return
+	}
+	for len(b) > 0 {
+		var ext sftp.Extension
+		if ext.Name, b, err = takeStr(b); err != nil {
+			return
+		}
+		if ext.Data, b, err = takeStr(b); err != nil {
+			return
+		}
+		extensions = append(extensions, ext)
+	}
+	return
+}
+
+// Close closes the connection, which ends the session.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+var errShortPacket = errors.New("sftptest: packet too short")
+
+func appendU32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func takeU32(b []byte) (uint32, []byte, error) {
+	if len(b) < 4 {
+		return 0, b, errShortPacket
+	}
+	return binary.BigEndian.Uint32(b), b[4:], nil
+}
+
+func takeStr(b []byte) (string, []byte, error) {
+	n, b, err := takeU32(b)
+	if err != nil {
+		return "", b, err
+	}
+	if uint32(len(b)) < n {
+		return "", b, errShortPacket
+	}
+	return string(b[:n]), b[n:], nil
+}
@@ -0,0 +1,332 @@
+// Package sftptest provides utilities for testing SFTP RequestHandler
+// implementations, and a raw packet Client for testing the server itself
+// without SSH.
+package sftptest
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/tera-insights/sftp"
+)
+
+// TestRequestHandler runs a suite of conformance tests against a
+// RequestHandler, checking that it honors the contracts documented on the
+// interface. Each test calls newHandler to obtain a handler and the path of an
+// existing, empty directory within it, under which the test creates its files.
+// Mostly only whether operations fail is checked, not which errors they
+// return, except where clients depend on the status code.
+//
+// Handlers which do not support some operations, e.g. read-only handlers,
+// will fail the corresponding tests.
+func TestRequestHandler(t *testing.T, newHandler func() (handler sftp.RequestHandler, root string)) {
+	for _, tc := range conformanceTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			h, root := newHandler()
+			tc.run(t, h, root)
+		})
+	}
+}
+
+var conformanceTests = []struct {
+	name string
+	run  func(t *testing.T, h sftp.RequestHandler, root string)
+}{
+	{"CreateWriteRead", testCreateWriteRead},
+	{"OpenMissing", testOpenMissing},
+	{"OpenExclusive", testOpenExclusive},
+	{"OpenTruncate", testOpenTruncate},
+	{"OpenDirectory", testOpenDirectory},
+	{"Stat", testStat},
+	{"StatRoot", testStatRoot},
+	{"SetstatSize", testSetstatSize},
+	{"Rename", testRename},
+	{"RenameOverExisting", testRenameOverExisting},
+	{"Remove", testRemove},
+	{"Mkdir", testMkdir},
+	{"Rmdir", testRmdir},
+	{"ReadDir", testReadDir},
+	{"OpenDirOnFile", testOpenDirOnFile},
+}
+
+func testCreateWriteRead(t *testing.T, h sftp.RequestHandler, root string) {
+	name := path.Join(root, "file")
+	f, err := h.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(O_RDWR|O_CREATE): %v", err)
+	}
+	defer f.Close()
+
+	want := []byte("hello, world")
+	if n, err := f.WriteAt(want, 0); err != nil || n != len(want) {
+		t.Fatalf("WriteAt = %d, %v; want %d, nil", n, err, len(want))
+	}
+	got := make([]byte, len(want))
+	if n, err := f.ReadAt(got, 0); (err != nil && err != io.EOF) || n != len(want) {
+		t.Fatalf("ReadAt = %d, %v; want %d, nil or io.EOF", n, err, len(want))
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read back %q, want %q", got, want)
+	}
+	if n, err := f.ReadAt(got, int64(len(want))); err != io.EOF || n != 0 {
+		t.Fatalf("ReadAt past end = %d, %v; want 0, io.EOF", n, err)
+	}
+}
+
+func testOpenMissing(t *testing.T, h sftp.RequestHandler, root string) {
+	f, err := h.OpenFile(path.Join(root, "missing"), os.O_RDONLY, 0)
+	if err == nil {
+		f.Close()
+		t.Fatal("OpenFile of a missing file without O_CREATE succeeded")
+	}
+	checkNotExist(t, "OpenFile of a missing file", err)
+
+	f, err = h.OpenFile(path.Join(root, "missing", "file"), os.O_WRONLY|os.O_CREATE, 0644)
+	if err == nil {
+		f.Close()
+		t.Fatal("OpenFile(O_CREATE) in a missing directory succeeded")
+	}
+	checkNotExist(t, "OpenFile(O_CREATE) in a missing directory", err)
+}
+
+// checkNotExist checks that the error would be reported to clients as
+// SSH_FX_NO_SUCH_FILE or SSH_FX_NO_SUCH_PATH, which they rely upon to tell
+// a missing file apart from other failures.
+func checkNotExist(t *testing.T, what string, err error) {
+	t.Helper()
+	switch sftp.StatusFromError(err).Code {
+	case sftp.StatusFromError(sftp.ErrNoSuchFile).Code, sftp.StatusFromError(sftp.ErrNoSuchPath).Code:
+	default:
+		t.Fatalf("%s failed with %v; want ErrNoSuchFile or ErrNoSuchPath", what, err)
+	}
+}
+
+func testOpenExclusive(t *testing.T, h sftp.RequestHandler, root string) {
+	name := createFile(t, h, root, "file", "data")
+	if f, err := h.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+		f.Close()
+		t.Fatal("OpenFile(O_CREATE|O_EXCL) of an existing file succeeded")
+	}
+}
+
+func testOpenTruncate(t *testing.T, h sftp.RequestHandler, root string) {
+	name := createFile(t, h, root, "file", "data")
+	f, err := h.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(O_TRUNC): %v", err)
+	}
+	f.Close()
+	checkSize(t, h, name, 0)
+}
+
+func testOpenDirectory(t *testing.T, h sftp.RequestHandler, root string) {
+	if f, err := h.OpenFile(root, os.O_RDONLY, 0); err == nil {
+		f.Close()
+		t.Fatal("OpenFile of a directory succeeded")
+	}
+}
+
+func testStat(t *testing.T, h sftp.RequestHandler, root string) {
+	name := createFile(t, h, root, "file", "data")
+	info, err := h.Stat(name)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Name() != "file" || info.Size() != 4 || info.IsDir() {
+		t.Fatalf("Stat = {name %q, size %d, dir %v}; want {\"file\", 4, false}",
+			info.Name(), info.Size(), info.IsDir())
+	}
+	if info, err := h.Stat(root); err != nil || !info.IsDir() {
+		t.Fatalf("Stat of directory = %v, %v; want a directory", info, err)
+	}
+	if _, err := h.Stat(path.Join(root, "missing")); err == nil {
+		t.Fatal("Stat of a missing file succeeded")
+	}
+	if _, err := h.Lstat(path.Join(root, "missing")); err == nil {
+		t.Fatal("Lstat of a missing file succeeded")
+	}
+}
+
+// testStatRoot checks the root itself, which clients stat at startup and which
+// some handlers, e.g. those serving a subdirectory, must map specially.
+func testStatRoot(t *testing.T, h sftp.RequestHandler, root string) {
+	if info, err := h.Stat("/"); err != nil || !info.IsDir() {
+		t.Fatalf("Stat(\"/\") = %v, %v; want a directory", info, err)
+	}
+}
+
+func testSetstatSize(t *testing.T, h sftp.RequestHandler, root string) {
+	name := createFile(t, h, root, "file", "data")
+	if err := h.Setstat(name, &sftp.FileAttr{Flags: sftp.AttrFlagSize, Size: 2}); err != nil {
+		t.Fatalf("Setstat(size): %v", err)
+	}
+	checkSize(t, h, name, 2)
+}
+
+func testRename(t *testing.T, h sftp.RequestHandler, root string) {
+	oldpath := createFile(t, h, root, "old", "data")
+	newpath := path.Join(root, "new")
+	if err := h.Rename(oldpath, newpath); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := h.Stat(oldpath); err == nil {
+		t.Fatal("old path still exists after Rename")
+	}
+	checkSize(t, h, newpath, 4)
+	if err := h.Rename(oldpath, newpath+"2"); err == nil {
+		t.Fatal("Rename of a missing path succeeded")
+	}
+}
+
+func testRenameOverExisting(t *testing.T, h sftp.RequestHandler, root string) {
+	oldpath := createFile(t, h, root, "old", "old")
+	newpath := createFile(t, h, root, "new", "new data")
+	if err := h.Rename(oldpath, newpath); err == nil {
+		t.Fatal("Rename over an existing path succeeded")
+	}
+	checkSize(t, h, newpath, 8)
+}
+
+func testRemove(t *testing.T, h sftp.RequestHandler, root string) {
+	name := createFile(t, h, root, "file", "data")
+	if err := h.Remove(name); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := h.Stat(name); err == nil {
+		t.Fatal("file still exists after Remove")
+	}
+	if err := h.Remove(name); err == nil {
+		t.Fatal("Remove of a missing file succeeded")
+	}
+	dir := mkdir(t, h, root, "dir")
+	if err := h.Remove(dir); err == nil {
+		t.Fatal("Remove of a directory succeeded")
+	}
+}
+
+func testMkdir(t *testing.T, h sftp.RequestHandler, root string) {
+	dir := mkdir(t, h, root, "dir")
+	if info, err := h.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("Stat after Mkdir = %v, %v; want a directory", info, err)
+	}
+	if err := h.Mkdir(dir, &sftp.FileAttr{}); err == nil {
+		t.Fatal("Mkdir of an existing path succeeded")
+	}
+	if err := h.Mkdir(path.Join(root, "missing", "dir"), &sftp.FileAttr{}); err == nil {
+		t.Fatal("Mkdir in a missing directory succeeded")
+	}
+}
+
+func testRmdir(t *testing.T, h sftp.RequestHandler, root string) {
+	dir := mkdir(t, h, root, "dir")
+	createFile(t, h, dir, "file", "data")
+	if err := h.Rmdir(dir); err == nil {
+		t.Fatal("Rmdir of a non-empty directory succeeded")
+	}
+	empty := mkdir(t, h, root, "empty")
+	if err := h.Rmdir(empty); err != nil {
+		t.Fatalf("Rmdir: %v", err)
+	}
+	if _, err := h.Stat(empty); err == nil {
+		t.Fatal("directory still exists after Rmdir")
+	}
+	if err := h.Rmdir(path.Join(dir, "file")); err == nil {
+		t.Fatal("Rmdir of a file succeeded")
+	}
+}
+
+func testReadDir(t *testing.T, h sftp.RequestHandler, root string) {
+	want := []string{"a", "b", "c", "d", "e"}
+	for _, name := range want[:4] {
+		createFile(t, h, root, name, name)
+	}
+	mkdir(t, h, root, want[4])
+
+	d, err := h.OpenDir(root)
+	if err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+	if closer, ok := d.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	var got []string
+	dst := make([]os.FileInfo, 2) // smaller than the listing, to test pagination
+	for {
+		n, err := d.ReadEntries(dst)
+		for _, info := range dst[:n] {
+			got = append(got, info.Name())
+			if isDir := info.Name() == "e"; info.IsDir() != isDir {
+				t.Errorf("entry %q: IsDir() = %v, want %v", info.Name(), info.IsDir(), isDir)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("ReadEntries: %v", err)
+		} else if n < len(dst) {
+			t.Fatalf("ReadEntries returned %d < %d entries without an error", n, len(dst))
+		}
+	}
+
+	sort.Strings(got)
+	if len(got) != len(want) {
+		t.Fatalf("listed %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("listed %q, want %q", got, want)
+		}
+	}
+}
+
+func testOpenDirOnFile(t *testing.T, h sftp.RequestHandler, root string) {
+	name := createFile(t, h, root, "file", "data")
+	if _, err := h.OpenDir(name); err == nil {
+		t.Fatal("OpenDir of a file succeeded")
+	}
+	if _, err := h.OpenDir(path.Join(root, "missing")); err == nil {
+		t.Fatal("OpenDir of a missing path succeeded")
+	}
+}
+
+// createFile creates a file with the given contents and returns its path.
+func createFile(t *testing.T, h sftp.RequestHandler, dir, name, content string) string {
+	t.Helper()
+	name = path.Join(dir, name)
+	f, err := h.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(%q, O_CREATE): %v", name, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte(content), 0); err != nil {
+		t.Fatalf("WriteAt(%q): %v", name, err)
+	}
+	return name
+}
+
+// mkdir creates a directory and returns its path.
+func mkdir(t *testing.T, h sftp.RequestHandler, dir, name string) string {
+	t.Helper()
+	name = path.Join(dir, name)
+	if err := h.Mkdir(name, &sftp.FileAttr{Flags: sftp.AttrFlagPermissions, Perms: 0755}); err != nil {
+		t.Fatalf("Mkdir(%q): %v", name, err)
+	}
+	return name
+}
+
+func checkSize(t *testing.T, h sftp.RequestHandler, name string, want int64) {
+	t.Helper()
+	info, err := h.Stat(name)
+	if err != nil {
+		t.Fatalf("Stat(%q): %v", name, err)
+	}
+	if info.Size() != want {
+		t.Fatalf("Stat(%q).Size() = %d, want %d", name, info.Size(), want)
+	}
+}
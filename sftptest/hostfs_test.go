@@ -0,0 +1,15 @@
+package sftptest_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/tera-insights/sftp"
+	"github.com/tera-insights/sftp/sftptest"
+)
+
+func TestHostFS(t *testing.T) {
+	sftptest.TestRequestHandler(t, func() (sftp.RequestHandler, string) {
+		return sftp.HostFS(sftp.HostFSOpts{AllowWrite: true}), filepath.ToSlash(t.TempDir())
+	})
+}
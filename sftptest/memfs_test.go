@@ -0,0 +1,14 @@
+package sftptest_test
+
+import (
+	"testing"
+
+	"github.com/tera-insights/sftp"
+	"github.com/tera-insights/sftp/sftptest"
+)
+
+func TestMemFS(t *testing.T) {
+	sftptest.TestRequestHandler(t, func() (sftp.RequestHandler, string) {
+		return sftp.MemFS(), "/"
+	})
+}
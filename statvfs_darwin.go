@@ -6,7 +6,7 @@ import (
 
 func statVFS(path string) (*StatVFS, error) {
 	var stat syscall.Statfs_t
-	if err := syscall.Statfs(path, &stat); err != nil {
+	if err := retryEINTR(func() error { return syscall.Statfs(path, &stat) }); err != nil {
 		return nil, err
 	}
 	return &StatVFS{
@@ -17,9 +17,9 @@ func statVFS(path string) (*StatVFS, error) {
 		BlocksAvail: stat.Bavail,
 		Files:       stat.Files,
 		FilesFree:   stat.Ffree,
-		FilesAvail:  stat.Ffree,                                                      // not sure how to calculate Favail
-		FSID:        uint64(uint64(stat.Fsid.Val[1])<<32 | uint64(stat.Fsid.Val[0])), // endianness?
-		Flag:        uint64(stat.Flags),                                              // assuming POSIX?
-		MaxNameLen:  1024,                                                            // man 2 statfs shows: #define MAXPATHLEN      1024
+		FilesAvail:  stat.Ffree,                       // statfs(2) has no separate count, so statvfs(3) does the same
+		FSID:        uint64(uint32(stat.Fsid.Val[0])), // statvfs(3), and so OpenSSH, only reports val[0]
+		Flag:        uint64(stat.Flags),               // assuming POSIX?
+		MaxNameLen:  1024,                             // man 2 statfs shows: #define MAXPATHLEN      1024
 	}, nil
 }
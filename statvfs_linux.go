@@ -8,7 +8,7 @@ import (
 
 func statVFS(path string) (*StatVFS, error) {
 	var stat syscall.Statfs_t
-	if err := syscall.Statfs(path, &stat); err != nil {
+	if err := retryEINTR(func() error { return syscall.Statfs(path, &stat) }); err != nil {
 		return nil, err
 	}
 	return &StatVFS{
@@ -19,7 +19,7 @@ func statVFS(path string) (*StatVFS, error) {
 		BlocksAvail: stat.Bavail,
 		Files:       stat.Files,
 		FilesFree:   stat.Ffree,
-		FilesAvail:  stat.Ffree,         // not sure how to calculate Favail
+		FilesAvail:  stat.Ffree,         // Linux reserves no inodes for root, so glibc's statvfs(3) does the same
 		Flag:        uint64(stat.Flags), // assuming POSIX?
 		MaxNameLen:  uint64(stat.Namelen),
 	}, nil
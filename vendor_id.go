@@ -0,0 +1,73 @@
+package sftp
+
+import (
+	runtimedebug "runtime/debug"
+)
+
+// modulePath is the import path of this module, which is the default product
+// name reported by the "vendor-id" extension.
+const modulePath = "github.com/tera-insights/sftp"
+
+// A VendorID identifies the implementation of an SFTP server, as reported to
+// clients by the "vendor-id" extension described in
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-13#section-5.4.
+type VendorID struct {
+	VendorName     string
+	ProductName    string
+	ProductVersion string
+	BuildNumber    uint64
+}
+
+// defaultVendorID identifies this library, at the version recorded in the
+// build info of the running binary, if any.
+func defaultVendorID() VendorID {
+	id := VendorID{
+		VendorName:     "Tera Insights",
+		ProductName:    modulePath,
+		ProductVersion: "(devel)",
+	}
+	if info, ok := runtimedebug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath {
+			id.ProductVersion = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				id.ProductVersion = dep.Version
+			}
+		}
+	}
+	return id
+}
+
+// vendorID returns the VendorID the server reports.
+func (s *server) vendorID() VendorID {
+	if s.VendorID != (VendorID{}) {
+		return s.VendorID
+	}
+	return defaultVendorID()
+}
+
+func (id VendorID) encodedSize() int {
+	return (4 + len(id.VendorName)) + (4 + len(id.ProductName)) + (4 + len(id.ProductVersion)) + 8
+}
+
+func appendVendorID(b []byte, id VendorID) []byte {
+	b = appendStr(b, id.VendorName)
+	b = appendStr(b, id.ProductName)
+	b = appendStr(b, id.ProductVersion)
+	return appendU64(b, id.BuildNumber)
+}
+
+func takeVendorID(b []byte) (id VendorID, _ []byte, err error) {
+	if id.VendorName, b, err = takeStr(b); err != nil {
+		return
+	}
+	if id.ProductName, b, err = takeStr(b); err != nil {
+		return
+	}
+	if id.ProductVersion, b, err = takeStr(b); err != nil {
+		return
+	}
+	id.BuildNumber, b, err = takeU64(b)
+	return id, b, err
+}